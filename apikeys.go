@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Api keys look like "pt_<prefix>_<secret>". The prefix is stored as is to
+// find the key, the whole key is only stored hashed.
+const apiKeyMarker = "pt_"
+
+// apiKeyPrincipal is put in the context of requests made with an api key.
+type apiKeyPrincipal struct {
+	id     string
+	scopes []api.ApiKeyScope
+}
+
+// allows reports whether the key can be used for an rpc that needs the scope,
+// rpcs that don't declare a scope can't be called with an api key at all.
+func (k *apiKeyPrincipal) allows(scope api.ApiKeyScope) bool {
+	if scope == api.ApiKeyScope_API_KEY_SCOPE_UNSPECIFIED {
+		return false
+	}
+	if len(k.scopes) == 0 {
+		return true
+	}
+	for _, s := range k.scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyApiKey looks up the key and returns the id of its owner.
+func (a *authenticator) verifyApiKey(ctx context.Context, key string) (string, *apiKeyPrincipal, error) {
+	parts := strings.Split(strings.TrimPrefix(key, apiKeyMarker), "_")
+	if !strings.HasPrefix(key, apiKeyMarker) || len(parts) != 2 {
+		return "", nil, status.Errorf(codes.Unauthenticated, "invalid api key")
+	}
+
+	var (
+		id      string
+		userID  string
+		keyHash string
+		scopes  []string
+		stale   bool
+	)
+	err := a.db.conn.QueryRow(ctx, `
+		SELECT api_keys.id, api_keys.user_id, api_keys.key_hash, api_keys.scopes,
+			api_keys.last_used_at IS NULL OR api_keys.last_used_at < now() - interval '1 minute'
+		FROM api_keys
+		JOIN users ON users.id = api_keys.user_id
+		WHERE api_keys.prefix = $1
+		AND api_keys.revoked_at IS NULL
+		AND users.deleted_at IS NULL
+	`, apiKeyMarker+parts[0]).Scan(&id, &userID, &keyHash, &scopes, &stale)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return "", nil, status.Errorf(codes.Unauthenticated, "invalid api key")
+		}
+		return "", nil, status.Errorf(codes.Internal, "failed to verify api key: %v", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(key)), []byte(keyHash)) != 1 {
+		return "", nil, status.Errorf(codes.Unauthenticated, "invalid api key")
+	}
+
+	// last_used_at is only precise to the minute so busy scripts don't
+	// cause a write on every request
+	if stale {
+		if _, err = a.db.conn.Exec(ctx, `
+			UPDATE api_keys
+			SET last_used_at = now()
+			WHERE id = $1
+		`, id); err != nil {
+			return "", nil, status.Errorf(codes.Internal, "failed to verify api key: %v", err)
+		}
+	}
+
+	return userID, &apiKeyPrincipal{id: id, scopes: scopesFromDB(scopes)}, nil
+}
+
+func scopesFromDB(names []string) []api.ApiKeyScope {
+	scopes := make([]api.ApiKeyScope, 0, len(names))
+	for _, name := range names {
+		scopes = append(scopes, api.ApiKeyScope(api.ApiKeyScope_value[name]))
+	}
+	return scopes
+}
+
+func scanApiKey(row pgx.Row) (*api.ApiKey, error) {
+	var (
+		key      api.ApiKey
+		scopes   []string
+		created  time.Time
+		lastUsed sql.NullTime
+	)
+	err := row.Scan(&key.Id, &key.Name, &key.Prefix, &scopes, &created, &lastUsed)
+	if err != nil {
+		return nil, err
+	}
+	key.Scopes = scopesFromDB(scopes)
+	key.CreatedAt = timestamppb.New(created.Truncate(60 * time.Second))
+	if lastUsed.Valid {
+		key.LastUsedAt = timestamppb.New(lastUsed.Time.Truncate(60 * time.Second))
+	}
+	return &key, nil
+}
+
+func (s *ApiServer) CreateApiKey(ctx context.Context, req *api.CreateApiKeyRequest) (*api.CreateApiKeyResponse, error) {
+	userID := ctx.Value(user)
+	if req.Name == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "name is required")
+	}
+
+	var scopes []string
+	for _, scope := range req.Scopes {
+		if scope == api.ApiKeyScope_API_KEY_SCOPE_UNSPECIFIED || api.ApiKeyScope_name[int32(scope)] == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid scope %v", scope)
+		}
+		scopes = append(scopes, scope.String())
+	}
+
+	prefix := apiKeyMarker + genRandomBytesHex(4)
+	key := prefix + "_" + genRandomBytesHex(24)
+
+	row := s.db.conn.QueryRow(ctx, `
+		INSERT INTO api_keys (user_id, key_name, prefix, key_hash, scopes)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, key_name, prefix, scopes, created_at, last_used_at
+	`,
+		userID,
+		req.Name,
+		prefix,
+		hashToken(key),
+		scopes,
+	)
+	apiKey, err := scanApiKey(row)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create api key: %v", err)
+	}
+
+	return &api.CreateApiKeyResponse{ApiKey: apiKey, Key: key, Message: fmt.Sprintf("api key %s created", apiKey.Name)}, nil
+}
+
+func (s *ApiServer) ListApiKeys(ctx context.Context, req *empty.Empty) (*api.ListApiKeysResponse, error) {
+	userID := ctx.Value(user)
+
+	rows, err := s.db.conn.Query(ctx, `
+		SELECT id, key_name, prefix, scopes, created_at, last_used_at
+		FROM api_keys
+		WHERE user_id = $1
+		AND revoked_at IS NULL
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to retrieve api keys: %v", err)
+	}
+	defer rows.Close()
+
+	var keys []*api.ApiKey
+	for rows.Next() {
+		key, err := scanApiKey(rows)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to retrieve api keys: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to retrieve api keys: %v", err)
+	}
+
+	return &api.ListApiKeysResponse{ApiKeys: keys, Message: "api keys retrieved"}, nil
+}
+
+func (s *ApiServer) RevokeApiKey(ctx context.Context, req *api.RevokeApiKeyRequest) (*api.RevokeApiKeyResponse, error) {
+	userID := ctx.Value(user)
+	if req.ApiKeyId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "api key id required")
+	}
+
+	tag, err := s.db.conn.Exec(ctx, `
+		UPDATE api_keys
+		SET revoked_at = now()
+		WHERE id = $1
+		AND user_id = $2
+		AND revoked_at IS NULL
+	`, req.ApiKeyId, userID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revoke api key: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.NotFound, "api key not found")
+	}
+
+	return &api.RevokeApiKeyResponse{Message: fmt.Sprintf("api key %s revoked", req.ApiKeyId)}, nil
+}
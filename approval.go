@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// In approval mode (APPROVAL_REQUIRED) new accounts have no activated_at
+// until an admin calls ActivateUser, and can't log in or call anything before.
+// Without it accounts are activated when they are created.
+
+// errAccountInactive is returned for accounts that still wait for approval.
+func errAccountInactive(userID string) error {
+	st := status.New(codes.FailedPrecondition, "your account is waiting for approval by an admin")
+	detailed, err := st.WithDetails(&errdetails.PreconditionFailure{
+		Violations: []*errdetails.PreconditionFailure_Violation{{
+			Type:        "ACCOUNT_ACTIVATION",
+			Subject:     userID,
+			Description: "the account has not been activated by an admin yet",
+		}},
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// checkActive refuses users that were not activated yet, it only asks the
+// database in approval mode.
+func (a *authenticator) checkActive(ctx context.Context, userID string) error {
+	if !a.approvalRequired {
+		return nil
+	}
+	var active bool
+	err := a.db.conn.QueryRow(ctx, `
+		SELECT activated_at IS NOT NULL
+		FROM users
+		WHERE id = $1
+		AND deleted_at IS NULL
+	`, userID).Scan(&active)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return status.Errorf(codes.Unauthenticated, "user not found")
+		}
+		return status.Errorf(codes.Internal, "failed to authenticate: %v", err)
+	}
+	if !active {
+		return errAccountInactive(userID)
+	}
+	return nil
+}
+
+func (s *ApiServer) ActivateUser(ctx context.Context, req *api.ActivateUserRequest) (*api.ActivateUserResponse, error) {
+	if req.UserId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user id is required")
+	}
+
+	row := s.db.conn.QueryRow(ctx, `
+		UPDATE users
+		SET activated_at = COALESCE(activated_at, now())
+		WHERE id = $1
+		AND deleted_at IS NULL
+		RETURNING `+userColumns,
+		req.UserId,
+	)
+	user, err := scanUser(row)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to activate user: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{subject: user.id, action: auditActivateUser, outcome: auditSuccess})
+
+	err = s.mailer.Send(ctx, mail{
+		To:      user.email,
+		Subject: "Your account was approved",
+		Body:    fmt.Sprintf("Your practice tracker account was approved, you can log in at %s now.\n", s.cfg.publicURL),
+	})
+	if err != nil {
+		log.Printf("failed to send approval email to %s: %v", user.email, err)
+	}
+
+	return &api.ActivateUserResponse{User: user.toProto(), Message: fmt.Sprintf("user %s activated", user.email)}, nil
+}
+
+func (s *ApiServer) ListPendingUsers(ctx context.Context, req *empty.Empty) (*api.ListPendingUsersResponse, error) {
+	rows, err := s.db.conn.Query(ctx, `
+		SELECT `+userColumns+`
+		FROM users
+		WHERE activated_at IS NULL
+		AND deleted_at IS NULL
+		ORDER BY created_at
+	`)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list pending users: %v", err)
+	}
+	defer rows.Close()
+
+	users := []*api.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to list pending users: %v", err)
+		}
+		users = append(users, user.toProto())
+	}
+	if err = rows.Err(); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list pending users: %v", err)
+	}
+
+	return &api.ListPendingUsersResponse{Users: users, Message: fmt.Sprintf("%d users waiting for approval", len(users))}, nil
+}
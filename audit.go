@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// audit actions
+const (
+	auditLogin          = "login"
+	auditAuthenticate   = "authenticate"
+	auditAuthorize      = "authorize"
+	auditCreateAccount  = "account.create"
+	auditActivateUser   = "account.activate"
+	auditUnlockAccount  = "account.unlock"
+	auditDeleteAccount  = "account.delete"
+	auditRestoreAccount = "account.restore"
+	auditPurgeAccount   = "account.purge"
+	auditExportAccount  = "account.export"
+	auditUpdateAccount  = "account.update"
+	auditChangeEmail    = "email.change"
+	auditCreateInvite   = "invite.create"
+	// impersonation
+	auditStartImpersonation = "impersonation.start"
+	auditImpersonatedCall   = "impersonation.call"
+	auditResetPassword      = "password.reset"
+	auditEnableTotp         = "totp.enable"
+	auditDisableTotp        = "totp.disable"
+)
+
+// audit outcomes
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+	auditDenied  = "denied"
+)
+
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 500
+)
+
+type auditEvent struct {
+	actorID string
+	subject string
+	action  string
+	outcome string
+	detail  string
+}
+
+// recordAudit appends the event to audit_events together with the caller's
+// ip and user agent. It writes outside of any transaction of the endpoint so
+// failures are kept when the transaction is rolled back. An event that can't
+// be written is logged instead of failing the request.
+func (db *Database) recordAudit(ctx context.Context, e auditEvent) {
+	if e.actorID == "" {
+		e.actorID, _ = ctx.Value(user).(string)
+	}
+	if svc, ok := ctx.Value(service).(*servicePrincipal); ok && e.actorID == "" {
+		e.actorID = svc.id()
+	}
+	_, err := db.conn.Exec(ctx, `
+		INSERT INTO audit_events (actor_id, subject, action, outcome, detail, ip, user_agent)
+		VALUES (NULLIF($1, ''), $2, $3, $4, $5, $6, $7)
+	`, e.actorID, e.subject, e.action, e.outcome, e.detail, clientIP(ctx), userAgent(ctx))
+	if err != nil {
+		log.Printf("failed to record audit event %s %s for %q: %v", e.action, e.outcome, e.actorID, err)
+	}
+}
+
+// userAgent returns the user agent of grpc clients, or the one of http
+// clients that the gateway forwards.
+func userAgent(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ua := firstValue(md, "grpcgateway-user-agent"); ua != "" {
+		return ua
+	}
+	return firstValue(md, "user-agent")
+}
+
+// withRequestMetadata adds the metadata the gateway would forward for the
+// request, for the http handlers that don't go through the gateway.
+func withRequestMetadata(r *http.Request) context.Context {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	md := metadata.Pairs("x-forwarded-for", ip, "grpcgateway-user-agent", r.UserAgent())
+	return metadata.NewIncomingContext(r.Context(), md)
+}
+
+func (s *ApiServer) ListAuditEvents(ctx context.Context, req *api.ListAuditEventsRequest) (*api.ListAuditEventsResponse, error) {
+	pageSize := int(req.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultAuditPageSize
+	}
+	if pageSize > maxAuditPageSize {
+		pageSize = maxAuditPageSize
+	}
+
+	// the events are listed newest first, the page token is the id of the
+	// last event of the previous page
+	var before *int64
+	if req.PageToken != "" {
+		id, err := strconv.ParseInt(req.PageToken, 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid page token")
+		}
+		before = &id
+	}
+	var start, end *time.Time
+	if req.StartTime != nil {
+		t := req.StartTime.AsTime()
+		start = &t
+	}
+	if req.EndTime != nil {
+		t := req.EndTime.AsTime()
+		end = &t
+	}
+
+	// created_at is a utc timestamp without time zone, the bounds are
+	// converted so the window doesn't depend on the session time zone
+	rows, err := s.db.conn.Query(ctx, `
+		SELECT id, COALESCE(actor_id, ''), subject, action, outcome, detail, ip, user_agent, created_at
+		FROM audit_events
+		WHERE ($1 = '' OR actor_id = $1)
+		AND ($2 = '' OR action = $2)
+		AND ($3::timestamptz IS NULL OR created_at >= $3::timestamptz AT TIME ZONE 'UTC')
+		AND ($4::timestamptz IS NULL OR created_at < $4::timestamptz AT TIME ZONE 'UTC')
+		AND ($5::bigint IS NULL OR id < $5)
+		ORDER BY id DESC
+		LIMIT $6
+	`, req.ActorId, req.Action, start, end, before, pageSize+1)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list audit events: %v", err)
+	}
+	defer rows.Close()
+
+	var events []*api.AuditEvent
+	for rows.Next() {
+		var (
+			e         api.AuditEvent
+			createdAt time.Time
+		)
+		if err = rows.Scan(&e.Id, &e.ActorId, &e.Subject, &e.Action, &e.Outcome, &e.Detail, &e.Ip, &e.UserAgent, &createdAt); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to list audit events: %v", err)
+		}
+		e.CreatedAt = timestamppb.New(createdAt)
+		events = append(events, &e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list audit events: %v", err)
+	}
+
+	var next string
+	if len(events) > pageSize {
+		events = events[:pageSize]
+		next = strconv.FormatInt(events[pageSize-1].Id, 10)
+	}
+
+	return &api.ListAuditEventsResponse{Events: events, NextPageToken: next, Message: fmt.Sprintf("%d audit events", len(events))}, nil
+}
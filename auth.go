@@ -4,7 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
 
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
@@ -17,49 +20,193 @@ type userID string
 
 var user userID = "userID"
 
+// Requests made with an api key carry the *apiKeyPrincipal under this key.
+var apiKey userID = "apiKey"
+
+// Requests made with a session token carry the session id under this key.
+var session userID = "sessionID"
+
+// Requests made by an internal service with a client certificate carry the
+// *servicePrincipal under this key.
+var service userID = "service"
+
+// While an admin impersonates a user, user holds the id of the user and
+// impersonator the id of the admin.
+var impersonator userID = "impersonatorID"
+
+// The session token is sent in this header by both http and grpc clients.
+const sessionHeader = "X-Atom-User"
+
+// authError converts a token verification error into the status returned to
+// clients.
+func authError(err error) *status.Status {
+	switch err {
+	case errExpiredToken:
+		return status.New(codes.Unauthenticated, "session expired, please log in again")
+	case errInvalidToken:
+		return status.New(codes.Unauthenticated, "invalid session token")
+	default:
+		return status.New(codes.Unauthenticated, "please log in")
+	}
+}
+
+// writeHTTPError formats the http error to be similar to grpc error responses
+func writeHTTPError(w http.ResponseWriter, s *status.Status) {
+	res := struct {
+		Code    codes.Code    `json:"code"`
+		Message string        `json:"message"`
+		Details []interface{} `json:"details"`
+	}{
+		Code:    s.Code(),
+		Message: s.Message(),
+		Details: s.Details(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(runtime.HTTPStatusFromCode(s.Code()))
+	json.NewEncoder(w).Encode(res)
+}
+
+// authenticator checks the credentials sent by http and grpc clients, it is
+// shared by both auth middlewares.
+type authenticator struct {
+	db     *Database
+	tokens *tokenSigner
+	// refuse the accounts that were not activated by an admin
+	approvalRequired bool
+	// the roles of the services that can authenticate with a client
+	// certificate, by common name
+	services map[string]api.Role
+}
+
+func newAuthenticator(db *Database, tokens *tokenSigner, approvalRequired bool, services map[string]api.Role) *authenticator {
+	return &authenticator{
+		db,
+		tokens,
+		approvalRequired,
+		services,
+	}
+}
+
+// authenticate accepts either a session token or an api key sent in the
+// authorization header, and returns the context the endpoints are called with.
+func (a *authenticator) authenticate(ctx context.Context, sessionToken, authorization string) (context.Context, error) {
+	if authorization != "" {
+		const bearer = "bearer "
+		if len(authorization) <= len(bearer) || !strings.EqualFold(authorization[:len(bearer)], bearer) {
+			return nil, status.Errorf(codes.Unauthenticated, "authorization header must be \"Bearer <api key>\"")
+		}
+		userID, key, err := a.verifyApiKey(ctx, authorization[len(bearer):])
+		if err != nil {
+			return nil, err
+		}
+		if err = a.checkActive(ctx, userID); err != nil {
+			return nil, err
+		}
+		ctx = context.WithValue(ctx, user, userID)
+		return context.WithValue(ctx, apiKey, key), nil
+	}
+
+	claims, err := a.tokens.verify(sessionToken)
+	if err != nil {
+		return nil, authError(err).Err()
+	}
+	if err = a.checkSession(ctx, claims.SessionID); err != nil {
+		return nil, err
+	}
+	if err = a.checkActive(ctx, claims.Subject); err != nil {
+		return nil, err
+	}
+	if claims.Impersonator != "" {
+		ctx = context.WithValue(ctx, impersonator, claims.Impersonator)
+	}
+	ctx = context.WithValue(ctx, user, claims.Subject)
+	return context.WithValue(ctx, session, claims.SessionID), nil
+}
+
 // http auth middleware func
-func httpAuthNFunc(ctx context.Context) func(http.Handler) http.Handler {
+func httpAuthNFunc(ctx context.Context, auth *authenticator) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-			if userID := r.Header.Get("x-atom-user"); userID != "" {
-				ctx = context.WithValue(r.Context(), user, userID)
-
-				next.ServeHTTP(w, r.WithContext(ctx))
-			} else {
-				err := status.New(codes.Unauthenticated, "please log in")
-				// Formatting the http error to be similar to grpc error responses
-				res := struct {
-					Code    codes.Code    `json:"code"`
-					Message string        `json:"message"`
-					Details []interface{} `json:"details"`
-				}{
-					Code:    err.Code(),
-					Message: err.Message(),
-					Details: err.Details(),
-				}
-
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusUnauthorized)
-				json.NewEncoder(w).Encode(res)
+			ctx := withRequestMetadata(r)
+			c, err := auth.authenticate(ctx, r.Header.Get(sessionHeader), r.Header.Get("Authorization"))
+			if err != nil {
+				auth.db.recordAudit(ctx, auditEvent{subject: r.URL.Path, action: auditAuthenticate, outcome: auditFailure, detail: status.Convert(err).Message()})
+				writeHTTPError(w, status.Convert(err))
+				return
 			}
+
+			next.ServeHTTP(w, r.WithContext(c))
 		})
 	}
 }
 
 // grpc auth middleware func
-func grpcAuthNFunc(ctx context.Context) func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+func grpcAuthNFunc(ctx context.Context, auth *authenticator) func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		c := ctx
+		// the public methods are declared with the policy option in
+		// service.proto, the http equivalents are registered outside of the
+		// auth middleware in main.go
+		if isPublic(info.FullMethod) {
+			return handler(ctx, req)
+		}
 
-		if md, ok := metadata.FromIncomingContext(ctx); ok {
-			if userID := md.Get("X-Atom-User")[0]; userID != "" {
-				c = context.WithValue(ctx, user, userID)
-				h, err := handler(c, req)
-				return h, err
+		md, _ := metadata.FromIncomingContext(ctx)
+		sessionToken, authorization := firstValue(md, sessionHeader), firstValue(md, "authorization")
+
+		// a service can still pass a user token to act as the user, on its
+		// own it has no user and authorize only lets it call the rpcs that
+		// allow services
+		if sessionToken == "" && authorization == "" {
+			if svc, ok := auth.servicePrincipal(ctx); ok {
+				return handler(context.WithValue(ctx, service, svc), req)
 			}
 		}
 
-		return nil, status.Errorf(codes.Unauthenticated, "please log in")
+		c, err := auth.authenticate(ctx, sessionToken, authorization)
+		if err != nil {
+			auth.db.recordAudit(ctx, auditEvent{subject: info.FullMethod, action: auditAuthenticate, outcome: auditFailure, detail: status.Convert(err).Message()})
+			return nil, err
+		}
+
+		return handler(c, req)
+	}
+}
+
+// grpc authorization middleware func, it runs after the authentication for
+// grpc requests and through the localConn for the gateway requests.
+func grpcAuthZFunc(ctx context.Context, db *Database) func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		// everything done while impersonating is recorded in the name of
+		// the admin
+		admin, impersonating := ctx.Value(impersonator).(string)
+
+		if err := authorize(ctx, db, info.FullMethod); err != nil {
+			if impersonating {
+				db.recordAudit(ctx, auditEvent{actorID: admin, subject: ctx.Value(user).(string), action: auditImpersonatedCall, outcome: auditDenied, detail: info.FullMethod + ": " + status.Convert(err).Message()})
+			} else {
+				db.recordAudit(ctx, auditEvent{subject: info.FullMethod, action: auditAuthorize, outcome: auditDenied, detail: status.Convert(err).Message()})
+			}
+			return nil, err
+		}
+
+		if !impersonating {
+			return handler(ctx, req)
+		}
+
+		res, err := handler(ctx, req)
+		outcome, detail := auditSuccess, info.FullMethod
+		if err != nil {
+			outcome, detail = auditFailure, info.FullMethod+": "+status.Convert(err).Message()
+		}
+		db.recordAudit(ctx, auditEvent{actorID: admin, subject: ctx.Value(user).(string), action: auditImpersonatedCall, outcome: outcome, detail: detail})
+		return res, err
+	}
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
 	}
+	return ""
 }
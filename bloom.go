@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// The breached password list is stored as a bloom filter over the SHA-1 of
+// the passwords, the same hashes the public breach corpora are published as.
+// The file starts with bloomMagic, k and m, followed by the m bits.
+const bloomMagic = "ptbloom1"
+
+type bloomFilter struct {
+	k    uint32
+	m    uint64
+	bits []byte
+}
+
+// newBloomFilter sizes the filter for n entries and the false positive rate.
+func newBloomFilter(n uint64, falsePositive float64) *bloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositive) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{k, m, make([]byte, (m+7)/8)}
+}
+
+// positions derives the k bit positions from the SHA-1 by double hashing.
+func (f *bloomFilter) positions(sum [sha1.Size]byte, fn func(uint64) bool) bool {
+	h1 := binary.BigEndian.Uint64(sum[0:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16]) | 1
+	for i := uint64(0); i < uint64(f.k); i++ {
+		if !fn((h1 + i*h2) % f.m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) add(sum [sha1.Size]byte) {
+	f.positions(sum, func(bit uint64) bool {
+		f.bits[bit/8] |= 1 << (bit % 8)
+		return true
+	})
+}
+
+func (f *bloomFilter) contains(sum [sha1.Size]byte) bool {
+	return f.positions(sum, func(bit uint64) bool {
+		return f.bits[bit/8]&(1<<(bit%8)) != 0
+	})
+}
+
+func (f *bloomFilter) containsPassword(password string) bool {
+	return f.contains(sha1.Sum([]byte(password)))
+}
+
+func (f *bloomFilter) writeTo(w io.Writer) error {
+	header := make([]byte, len(bloomMagic)+12)
+	copy(header, bloomMagic)
+	binary.BigEndian.PutUint32(header[len(bloomMagic):], f.k)
+	binary.BigEndian.PutUint64(header[len(bloomMagic)+4:], f.m)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(f.bits)
+	return err
+}
+
+func readBloomFilter(path string) (*bloomFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	header := make([]byte, len(bloomMagic)+12)
+	if _, err = io.ReadFull(r, header); err != nil || string(header[:len(bloomMagic)]) != bloomMagic {
+		return nil, fmt.Errorf("%s is not a breached password list, build one with build-breached-list", path)
+	}
+	f := &bloomFilter{
+		k: binary.BigEndian.Uint32(header[len(bloomMagic):]),
+		m: binary.BigEndian.Uint64(header[len(bloomMagic)+4:]),
+	}
+	if f.k == 0 || f.m == 0 {
+		return nil, errors.New("invalid breached password list header")
+	}
+	f.bits = make([]byte, (f.m+7)/8)
+	if _, err = io.ReadFull(r, f.bits); err != nil {
+		return nil, fmt.Errorf("breached password list is truncated: %v", err)
+	}
+	return f, nil
+}
+
+// parseBreachedLine accepts the lines of the published lists, "<sha1>" or
+// "<sha1>:<count>", and treats anything else as a plain text password.
+func parseBreachedLine(line string) ([sha1.Size]byte, bool) {
+	var sum [sha1.Size]byte
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return sum, false
+	}
+	hash := line
+	if i := strings.IndexByte(line, ':'); i == 2*sha1.Size {
+		hash = line[:i]
+	}
+	if len(hash) == 2*sha1.Size {
+		if _, err := hex.Decode(sum[:], []byte(hash)); err == nil {
+			return sum, true
+		}
+	}
+	return sha1.Sum([]byte(line)), true
+}
+
+// buildBreachedList reads the list twice, once to size the filter and once to
+// fill it, so lists that don't fit in memory can be used.
+func buildBreachedList(in, out string) error {
+	scan := func(fn func([sha1.Size]byte)) error {
+		file, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if sum, ok := parseBreachedLine(scanner.Text()); ok {
+				fn(sum)
+			}
+		}
+		return scanner.Err()
+	}
+
+	var n uint64
+	if err := scan(func([sha1.Size]byte) { n++ }); err != nil {
+		return err
+	}
+	f := newBloomFilter(n, 0.001)
+	if err := scan(f.add); err != nil {
+		return err
+	}
+
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	if err = f.writeTo(w); err != nil {
+		file.Close()
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBloomFilterRoundTrip(t *testing.T) {
+	f := newBloomFilter(1000, 0.001)
+	for i := 0; i < 1000; i++ {
+		f.add(sha1.Sum([]byte(fmt.Sprintf("password%d", i))))
+	}
+
+	path := filepath.Join(t.TempDir(), "breached.bloom")
+	var buf bytes.Buffer
+	if err := f.writeTo(&buf); err != nil {
+		t.Fatalf("writeTo: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readBloomFilter(path)
+	if err != nil {
+		t.Fatalf("readBloomFilter: %v", err)
+	}
+	if read.k != f.k || read.m != f.m || !bytes.Equal(read.bits, f.bits) {
+		t.Fatalf("readBloomFilter() = k %d m %d, want k %d m %d", read.k, read.m, f.k, f.m)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if password := fmt.Sprintf("password%d", i); !read.containsPassword(password) {
+			t.Errorf("containsPassword(%q) = false, want true", password)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if read.containsPassword(fmt.Sprintf("not breached %d", i)) {
+			falsePositives++
+		}
+	}
+	// sized for 0.1%, allow some slack
+	if falsePositives > 50 {
+		t.Errorf("%d false positives in 10000, want at most 50", falsePositives)
+	}
+}
+
+func TestReadBloomFilterInvalid(t *testing.T) {
+	var valid bytes.Buffer
+	if err := newBloomFilter(10, 0.01).writeTo(&valid); err != nil {
+		t.Fatalf("writeTo: %v", err)
+	}
+	header := make([]byte, len(bloomMagic)+12)
+	copy(header, bloomMagic)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"wrong magic", append([]byte("notbloom"), valid.Bytes()[len(bloomMagic):]...)},
+		{"zero k and m", header},
+		{"truncated", valid.Bytes()[:valid.Len()-1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "breached.bloom")
+			if err := os.WriteFile(path, tt.data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readBloomFilter(path); err == nil {
+				t.Errorf("readBloomFilter() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestParseBreachedLine(t *testing.T) {
+	sum := sha1.Sum([]byte("password"))
+	hash := fmt.Sprintf("%X", sum)
+	tests := []struct {
+		name string
+		line string
+		sum  [sha1.Size]byte
+		ok   bool
+	}{
+		{"hash", hash, sum, true},
+		{"lower case hash", fmt.Sprintf("%x", sum), sum, true},
+		{"hash with count", hash + ":3861493", sum, true},
+		{"plain text", "password", sum, true},
+		{"surrounding spaces", "  password\t", sum, true},
+		{"empty", "   ", [sha1.Size]byte{}, false},
+		{"not hex", "zz" + hash[2:], sha1.Sum([]byte("zz" + hash[2:])), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseBreachedLine(tt.line)
+			if ok != tt.ok || got != tt.sum {
+				t.Errorf("parseBreachedLine(%q) = %x, %v, want %x, %v", tt.line, got, ok, tt.sum, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Deleting an account sets users.deleted_at, revokes its sessions and leaves
+// its groups. For cfg.deletionGrace the owner can still restore it with
+// RestoreAccount, afterwards runAccountPurger removes the account and
+// everything it owns for good.
+
+// errAccountDeleted is returned when the owner of a deleted account tries to
+// log in.
+func errAccountDeleted(userID string, purgeAt time.Time) error {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf("your account was deleted, it can be restored until %s", purgeAt.UTC().Format(time.RFC1123)))
+	detailed, err := st.WithDetails(&errdetails.PreconditionFailure{
+		Violations: []*errdetails.PreconditionFailure_Violation{{
+			Type:        "ACCOUNT_DELETED",
+			Subject:     userID,
+			Description: "the account was deleted, call RestoreAccount to restore it",
+		}},
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// purgeAt returns when the account deleted at deletedAt is purged.
+func (s *ApiServer) purgeAt(deletedAt time.Time) time.Time {
+	return deletedAt.Add(s.cfg.deletionGrace)
+}
+
+var errWrongCredentials = status.Errorf(codes.Unauthenticated, "wrong password or code")
+
+// reauthenticate checks the password, and the totp code when two-factor
+// authentication is enabled, of a user that is about to do something that
+// can't be undone. Wrong credentials count towards the lockout like failed
+// logins.
+func (s *ApiServer) reauthenticate(ctx context.Context, tx pgx.Tx, u *userRecord, password, totpCode string) error {
+	if !u.password.Valid {
+		return status.Errorf(codes.FailedPrecondition, "your account has no password to confirm this with")
+	}
+	if password == "" {
+		return status.Errorf(codes.InvalidArgument, "password is required")
+	}
+	if err := s.checkLockout(ctx, throttleKeys(ctx, u.id)...); err != nil {
+		return err
+	}
+
+	ok, _, err := s.passwords.verify(u.password.String, password)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to check password: %v", err)
+	}
+	if ok {
+		enabled, err := totpEnabled(ctx, tx, u.id)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to check totp: %v", err)
+		}
+		if enabled {
+			if totpCode == "" {
+				return status.Errorf(codes.InvalidArgument, "totp code is required")
+			}
+			if ok, err = s.checkTOTP(ctx, tx, u.id, totpCode, true); err != nil {
+				return status.Errorf(codes.Internal, "failed to check totp: %v", err)
+			}
+		}
+	}
+	if !ok {
+		if err = s.loginFailed(ctx, u.id); err != nil {
+			return status.Errorf(codes.Internal, "failed to check password: %v", err)
+		}
+		return errWrongCredentials
+	}
+	return nil
+}
+
+func (s *ApiServer) DeleteAccount(ctx context.Context, req *api.DeleteAccountRequest) (*api.DeleteAccountResponse, error) {
+	callerID := ctx.Value(user).(string)
+	userID := req.UserId
+	if userID == "" {
+		userID = callerID
+	}
+
+	// admins can delete users, but not other admins
+	if userID != callerID {
+		role, err := callerRole(ctx, s.db)
+		if err != nil {
+			return nil, err
+		}
+		if role < api.Role_ROLE_ADMIN {
+			return nil, status.Errorf(codes.PermissionDenied, "you can only delete your own account")
+		}
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete account: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	row := tx.QueryRow(ctx, `
+		SELECT `+userColumns+`
+		FROM users
+		WHERE id = $1
+		FOR UPDATE
+	`, userID)
+	target, err := scanUser(row)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to delete account: %v", err)
+	}
+	if userID != callerID && roleFromUserType(target.userType) >= api.Role_ROLE_ADMIN {
+		return nil, status.Errorf(codes.PermissionDenied, "admins can't delete other admins")
+	}
+
+	if req.Perm {
+		// the caller confirms with their own credentials, which an admin
+		// deleting somebody else has too
+		caller := target
+		if userID != callerID {
+			row = tx.QueryRow(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, callerID)
+			if caller, err = scanUser(row); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to delete account: %v", err)
+			}
+		}
+		if err = s.reauthenticate(ctx, tx, caller, req.Password, req.TotpCode); err != nil {
+			s.db.recordAudit(ctx, auditEvent{subject: userID, action: auditDeleteAccount, outcome: auditDenied, detail: "re-authentication failed"})
+			return nil, err
+		}
+		if err = purgeAccount(ctx, tx, userID); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete account: %v", err)
+		}
+		if err = tx.Commit(ctx); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete account: %v", err)
+		}
+		s.db.recordAudit(ctx, auditEvent{subject: userID, action: auditPurgeAccount, outcome: auditSuccess, detail: "permanent"})
+
+		return &api.DeleteAccountResponse{Message: fmt.Sprintf("account %s deleted permanently", target.email)}, nil
+	}
+
+	if target.deletedAt.Valid {
+		return nil, status.Errorf(codes.FailedPrecondition, "account is already deleted")
+	}
+
+	// the memberships share the deletion time of the user, so a restore
+	// brings back just the ones that were left here
+	var deletedAt time.Time
+	if err = tx.QueryRow(ctx, `
+		UPDATE users
+		SET deleted_at = now()
+		WHERE id = $1
+		RETURNING deleted_at
+	`, userID).Scan(&deletedAt); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete account: %v", err)
+	}
+	if _, err = tx.Exec(ctx, `
+		UPDATE group_users
+		SET deleted_at = now()
+		WHERE user_id = $1
+		AND deleted_at IS NULL
+	`, userID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete account: %v", err)
+	}
+	if err = revokeUserSessions(ctx, tx, userID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete account: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete account: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{subject: userID, action: auditDeleteAccount, outcome: auditSuccess})
+
+	purgeAt := s.purgeAt(deletedAt)
+	return &api.DeleteAccountResponse{
+		Message: fmt.Sprintf("account %s deleted, it can be restored until %s", target.email, purgeAt.UTC().Format(time.RFC1123)),
+		PurgeAt: timestamppb.New(purgeAt),
+	}, nil
+}
+
+func (s *ApiServer) RestoreAccount(ctx context.Context, req *api.RestoreAccountRequest) (*api.RestoreAccountResponse, error) {
+	if req.Email == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "email is required")
+	}
+	if req.Password == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "password is required")
+	}
+	if err := s.checkLockout(ctx, throttleKeys(ctx, "")...); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to restore account: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	row := tx.QueryRow(ctx, `
+		SELECT `+userColumns+`
+		FROM users
+		WHERE email = $1
+		AND deleted_at > now() - $2::interval
+		FOR UPDATE
+	`, req.Email, s.cfg.deletionGrace)
+	u, err := scanUser(row)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, status.Errorf(codes.Internal, "failed to restore account: %v", err)
+	}
+	// unknown addresses, and accounts without a password to confirm with,
+	// get the answer of a wrong password, so the endpoint doesn't tell
+	// which addresses belong to deleted accounts. They count against the ip
+	// like failed logins.
+	if err == pgx.ErrNoRows || !u.password.Valid {
+		if err = s.loginFailed(ctx, ""); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to restore account: %v", err)
+		}
+		return nil, errWrongCredentials
+	}
+	if err = s.reauthenticate(ctx, tx, u, req.Password, req.TotpCode); err != nil {
+		s.db.recordAudit(ctx, auditEvent{actorID: u.id, subject: u.email, action: auditRestoreAccount, outcome: auditFailure, detail: "re-authentication failed"})
+		return nil, err
+	}
+
+	if _, err = tx.Exec(ctx, `
+		UPDATE group_users
+		SET deleted_at = NULL
+		WHERE user_id = $1
+		AND deleted_at = (SELECT deleted_at FROM users WHERE id = $1)
+	`, u.id); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to restore account: %v", err)
+	}
+	row = tx.QueryRow(ctx, `
+		UPDATE users
+		SET deleted_at = NULL
+		WHERE id = $1
+		RETURNING `+userColumns,
+		u.id,
+	)
+	if u, err = scanUser(row); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to restore account: %v", err)
+	}
+	if err = loginSucceeded(ctx, tx, u.id); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to restore account: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to restore account: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{actorID: u.id, subject: u.email, action: auditRestoreAccount, outcome: auditSuccess})
+
+	return &api.RestoreAccountResponse{User: u.toProto(), Message: fmt.Sprintf("account %s restored, you can log in again", u.email)}, nil
+}
+
+// purgeStatements remove a user and everything they own, children first.
+// Invites the user made stay usable.
+// $1 is the user id.
+var purgeStatements = []string{
+	`DELETE FROM ticket_lang WHERE ticket_id IN (SELECT id FROM tickets WHERE user_id = $1)`,
+	`DELETE FROM ticket_tech WHERE ticket_id IN (SELECT id FROM tickets WHERE user_id = $1)`,
+	`DELETE FROM ticket_yt_channels WHERE ticket_id IN (SELECT id FROM tickets WHERE user_id = $1)`,
+	`DELETE FROM ticket_resources WHERE ticket_id IN (SELECT id FROM tickets WHERE user_id = $1)`,
+	`DELETE FROM ticket_sources WHERE ticket_id IN (SELECT id FROM tickets WHERE user_id = $1)`,
+	`DELETE FROM ticket_docs WHERE ticket_id IN (SELECT id FROM tickets WHERE user_id = $1)`,
+	`DELETE FROM group_tickets
+	WHERE ticket_id IN (SELECT id FROM tickets WHERE user_id = $1)
+	OR group_id IN (SELECT id FROM groups WHERE user_id = $1)`,
+	`DELETE FROM tickets WHERE user_id = $1`,
+	`DELETE FROM group_users
+	WHERE user_id = $1
+	OR group_id IN (SELECT id FROM groups WHERE user_id = $1)`,
+	`DELETE FROM invites WHERE group_id IN (SELECT id FROM groups WHERE user_id = $1)`,
+	`UPDATE invites SET created_by = NULL WHERE created_by = $1`,
+	`DELETE FROM groups WHERE user_id = $1`,
+	`DELETE FROM export_jobs WHERE user_id = $1`,
+	`DELETE FROM email_changes WHERE user_id = $1`,
+	`DELETE FROM magic_links WHERE user_id = $1`,
+	`DELETE FROM totp_recovery_codes WHERE user_id = $1`,
+	`DELETE FROM user_totp WHERE user_id = $1`,
+	`DELETE FROM api_keys WHERE user_id = $1`,
+	`DELETE FROM user_identities WHERE user_id = $1`,
+	`DELETE FROM refresh_tokens WHERE user_id = $1`,
+	`DELETE FROM sessions WHERE user_id = $1`,
+	`DELETE FROM users WHERE id = $1`,
+}
+
+// purgeAccount removes the user and everything they own. The audit events
+// are kept.
+func purgeAccount(ctx context.Context, tx pgx.Tx, userID string) error {
+	for _, stmt := range purgeStatements {
+		if _, err := tx.Exec(ctx, stmt, userID); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(ctx, `DELETE FROM login_throttle WHERE key = $1`, accountThrottleKey(userID))
+	return err
+}
+
+// runAccountPurger purges the accounts whose grace period is over every
+// cfg.purgeInterval until ctx is done.
+func (s *ApiServer) runAccountPurger(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.purgeInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.purgeDeletedAccounts(ctx); err != nil {
+			log.Printf("failed to purge deleted accounts: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *ApiServer) purgeDeletedAccounts(ctx context.Context) error {
+	rows, err := s.db.conn.Query(ctx, `
+		SELECT id
+		FROM users
+		WHERE deleted_at <= now() - $1::interval
+	`, s.cfg.deletionGrace)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// every account is purged in its own transaction, so one failure doesn't
+	// hold back the others
+	for _, id := range ids {
+		purged, err := s.purgeDeletedAccount(ctx, id)
+		if err != nil {
+			log.Printf("failed to purge account %s: %v", id, err)
+			continue
+		}
+		if purged {
+			s.db.recordAudit(ctx, auditEvent{subject: id, action: auditPurgeAccount, outcome: auditSuccess, detail: "grace period over"})
+		}
+	}
+	return nil
+}
+
+func (s *ApiServer) purgeDeletedAccount(ctx context.Context, userID string) (bool, error) {
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	// the account could have been restored in the meantime, or be purged by
+	// another instance
+	var id string
+	err = tx.QueryRow(ctx, `
+		SELECT id
+		FROM users
+		WHERE id = $1
+		AND deleted_at <= now() - $2::interval
+		FOR UPDATE SKIP LOCKED
+	`, userID, s.cfg.deletionGrace).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err = purgeAccount(ctx, tx, userID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
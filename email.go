@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A new address is kept in email_changes until the link sent to it is opened,
+// then it replaces users.email and the old address gets a link to revert the
+// change for emailRevertTTL.
+const emailRevertTTL = 7 * 24 * time.Hour
+
+// accounts without a password can only change the email from a session that
+// logged in this recently
+const emailChangeRecentLogin = 10 * time.Minute
+
+// isUniqueViolation reports whether err is a violation of the constraint.
+func isUniqueViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == constraint
+}
+
+var errEmailTaken = status.Errorf(codes.AlreadyExists, "the email address is already used by another account")
+
+func (s *ApiServer) RequestEmailChange(ctx context.Context, req *api.RequestEmailChangeRequest) (*api.RequestEmailChangeResponse, error) {
+	userID := ctx.Value(user).(string)
+	newEmail := strings.TrimSpace(req.NewEmail)
+	if newEmail == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "new email is required")
+	}
+	if !strings.Contains(newEmail, "@") {
+		return nil, status.Errorf(codes.InvalidArgument, "new email is not an email address")
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to change email: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	row := tx.QueryRow(ctx, `
+		SELECT `+userColumns+`
+		FROM users
+		WHERE id = $1
+		AND deleted_at IS NULL
+		FOR UPDATE
+	`, userID)
+	u, err := scanUser(row)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to change email: %v", err)
+	}
+	if strings.EqualFold(u.email, newEmail) {
+		return nil, status.Errorf(codes.InvalidArgument, "new email is your current email")
+	}
+	// accounts that log in through a provider or with magic links have no
+	// password to confirm with, a fresh login stands in for it so a stolen
+	// token isn't enough to take over the account recovery
+	if u.password.Valid {
+		if err = s.reauthenticate(ctx, tx, u, req.CurrentPassword, req.TotpCode); err != nil {
+			s.db.recordAudit(ctx, auditEvent{subject: newEmail, action: auditChangeEmail, outcome: auditDenied, detail: "re-authentication failed"})
+			return nil, err
+		}
+	} else {
+		var recent bool
+		if sessionID, ok := ctx.Value(session).(string); ok {
+			if err = tx.QueryRow(ctx, `
+				SELECT EXISTS (
+					SELECT 1
+					FROM sessions
+					WHERE id = $1
+					AND user_id = $2
+					AND revoked_at IS NULL
+					AND created_at > now() - $3::interval
+				)
+			`, sessionID, userID, emailChangeRecentLogin).Scan(&recent); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to change email: %v", err)
+			}
+		}
+		if !recent {
+			s.db.recordAudit(ctx, auditEvent{subject: newEmail, action: auditChangeEmail, outcome: auditDenied, detail: "no recent login"})
+			return nil, status.Errorf(codes.FailedPrecondition, "please log in again, your account has no password so the email can only be changed within %s of logging in", emailChangeRecentLogin)
+		}
+	}
+
+	// checked again when the change is confirmed, the address can be taken
+	// in the meantime
+	var taken bool
+	if err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE email = $1)`, newEmail).Scan(&taken); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to change email: %v", err)
+	}
+	if taken {
+		return nil, errEmailTaken
+	}
+
+	// a new request replaces the pending one, so only the latest link works
+	if _, err = tx.Exec(ctx, `
+		DELETE FROM email_changes
+		WHERE user_id = $1
+		AND confirmed_at IS NULL
+	`, userID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to change email: %v", err)
+	}
+	token := genRandomBytesHex(20)
+	if _, err = tx.Exec(ctx, `
+		INSERT INTO email_changes (user_id, old_email, new_email, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, now() + $5::interval)
+	`, userID, u.email, newEmail, hashToken(token), s.cfg.emailVerifyTTL); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to change email: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to change email: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{subject: newEmail, action: auditChangeEmail, outcome: auditSuccess, detail: "requested"})
+
+	link := s.cfg.publicURL + "/v1/email-change/confirm?token=" + url.QueryEscape(token)
+	err = s.mailer.Send(ctx, mail{
+		To:      newEmail,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf(
+			"Please confirm that this is the new email address of your practice tracker account by opening the link below:\n\n%s\n\nThe link expires in %s. If you didn't ask for this, you can ignore this email.\n",
+			link,
+			s.cfg.emailVerifyTTL,
+		),
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to send confirmation email: %v", err)
+	}
+
+	return &api.RequestEmailChangeResponse{Message: fmt.Sprintf("confirmation email sent to %s", newEmail)}, nil
+}
+
+func (s *ApiServer) ConfirmEmailChange(ctx context.Context, req *api.ConfirmEmailChangeRequest) (*api.ConfirmEmailChangeResponse, error) {
+	if req.Token == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "token is required")
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to confirm email change: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var changeID, userID, oldEmail, newEmail string
+	err = tx.QueryRow(ctx, `
+		SELECT id, user_id, old_email, new_email
+		FROM email_changes
+		WHERE token_hash = $1
+		AND expires_at > now()
+		AND confirmed_at IS NULL
+		FOR UPDATE
+	`, hashToken(req.Token)).Scan(&changeID, &userID, &oldEmail, &newEmail)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid or expired confirmation token")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to confirm email change: %v", err)
+	}
+
+	// users_email_key settles races with other accounts claiming the same
+	// address, whichever commits second gets the violation
+	row := tx.QueryRow(ctx, `
+		UPDATE users
+		SET email = $3, email_verified = true, email_verify_token = NULL, email_verify_token_expires = NULL
+		WHERE id = $1
+		AND email = $2
+		AND deleted_at IS NULL
+		RETURNING `+userColumns,
+		userID, oldEmail, newEmail,
+	)
+	u, err := scanUser(row)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.FailedPrecondition, "the email of the account changed since, please request the change again")
+		}
+		if isUniqueViolation(err, "users_email_key") {
+			return nil, errEmailTaken
+		}
+		return nil, status.Errorf(codes.Internal, "failed to confirm email change: %v", err)
+	}
+
+	revertToken := genRandomBytesHex(20)
+	if _, err = tx.Exec(ctx, `
+		UPDATE email_changes
+		SET confirmed_at = now(), revert_token_hash = $2, revert_expires_at = now() + $3::interval
+		WHERE id = $1
+	`, changeID, hashToken(revertToken), emailRevertTTL); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to confirm email change: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		if isUniqueViolation(err, "users_email_key") {
+			return nil, errEmailTaken
+		}
+		return nil, status.Errorf(codes.Internal, "failed to confirm email change: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{actorID: userID, subject: newEmail, action: auditChangeEmail, outcome: auditSuccess, detail: "confirmed"})
+
+	// the change is done at this point, the notification is best effort
+	link := s.cfg.publicURL + "/v1/email-change/revert?token=" + url.QueryEscape(revertToken)
+	err = s.mailer.Send(ctx, mail{
+		To:      oldEmail,
+		Subject: "Your email address was changed",
+		Body: fmt.Sprintf(
+			"The email address of your practice tracker account was changed to %s.\n\nIf this wasn't you, open the link below to change it back and sign out everywhere:\n\n%s\n\nThe link expires in %s.\n",
+			newEmail,
+			link,
+			emailRevertTTL,
+		),
+	})
+	if err != nil {
+		log.Printf("failed to send email changed notice to %s: %v", oldEmail, err)
+	}
+
+	return &api.ConfirmEmailChangeResponse{User: u.toProto(), Message: fmt.Sprintf("email changed to %s", newEmail)}, nil
+}
+
+func (s *ApiServer) RevertEmailChange(ctx context.Context, req *api.RevertEmailChangeRequest) (*api.RevertEmailChangeResponse, error) {
+	if req.Token == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "token is required")
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revert email change: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var changeID, userID, oldEmail string
+	err = tx.QueryRow(ctx, `
+		SELECT id, user_id, old_email
+		FROM email_changes
+		WHERE revert_token_hash = $1
+		AND revert_expires_at > now()
+		AND reverted_at IS NULL
+		FOR UPDATE
+	`, hashToken(req.Token)).Scan(&changeID, &userID, &oldEmail)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid or expired revert token")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to revert email change: %v", err)
+	}
+
+	// whoever changed the address could have asked for a password reset
+	// through it, so the pending reset goes too
+	tag, err := tx.Exec(ctx, `
+		UPDATE users
+		SET email = $2, email_verified = true, reset_password_token = NULL, reset_password_token_expires = NULL
+		WHERE id = $1
+		AND deleted_at IS NULL
+	`, userID, oldEmail)
+	if err != nil {
+		if isUniqueViolation(err, "users_email_key") {
+			return nil, status.Errorf(codes.FailedPrecondition, "%s is used by another account now", oldEmail)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to revert email change: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	if _, err = tx.Exec(ctx, `
+		UPDATE email_changes
+		SET reverted_at = now()
+		WHERE id = $1
+	`, changeID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revert email change: %v", err)
+	}
+	if _, err = tx.Exec(ctx, `
+		DELETE FROM email_changes
+		WHERE user_id = $1
+		AND confirmed_at IS NULL
+	`, userID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revert email change: %v", err)
+	}
+	if err = revokeUserSessions(ctx, tx, userID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revert email change: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		if isUniqueViolation(err, "users_email_key") {
+			return nil, status.Errorf(codes.FailedPrecondition, "%s is used by another account now", oldEmail)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to revert email change: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{actorID: userID, subject: oldEmail, action: auditChangeEmail, outcome: auditSuccess, detail: "reverted"})
+
+	return &api.RevertEmailChangeResponse{Message: fmt.Sprintf("email changed back to %s and every session signed out, please reset your password", oldEmail)}, nil
+}
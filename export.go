@@ -0,0 +1,485 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/genproto/googleapis/api/httpbody"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ExportAccount only queues an export job. runExportWorker picks the jobs up,
+// builds the archive and keeps it in export_jobs until it expires.
+const (
+	exportTTL          = 7 * 24 * time.Hour
+	exportPollInterval = 5 * time.Second
+	// a job running for longer than this was left behind by a worker that
+	// stopped, another worker starts it over
+	exportStaleAfter = 10 * time.Minute
+)
+
+// the states of export_jobs.status
+const (
+	exportPending = "pending"
+	exportRunning = "running"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+)
+
+var exportStatuses = map[string]api.ExportJobStatus{
+	exportPending: api.ExportJobStatus_EXPORT_JOB_STATUS_PENDING,
+	exportRunning: api.ExportJobStatus_EXPORT_JOB_STATUS_RUNNING,
+	exportReady:   api.ExportJobStatus_EXPORT_JOB_STATUS_READY,
+	exportFailed:  api.ExportJobStatus_EXPORT_JOB_STATUS_FAILED,
+}
+
+// exportJobColumns are the export_jobs columns in the order scanExportJob
+// expects them.
+const exportJobColumns = `id, status, error, COALESCE(length(archive), 0), created_at, completed_at, expires_at`
+
+func scanExportJob(row pgx.Row) (*api.ExportJob, error) {
+	var (
+		job       api.ExportJob
+		state     string
+		created   time.Time
+		completed sql.NullTime
+		expires   sql.NullTime
+	)
+	if err := row.Scan(&job.Id, &state, &job.Error, &job.SizeBytes, &created, &completed, &expires); err != nil {
+		return nil, err
+	}
+	job.Status = exportStatuses[state]
+	job.CreatedAt = timestamppb.New(created)
+	if completed.Valid {
+		job.CompletedAt = timestamppb.New(completed.Time)
+	}
+	if expires.Valid {
+		job.ExpiresAt = timestamppb.New(expires.Time)
+	}
+	return &job, nil
+}
+
+func (s *ApiServer) ExportAccount(ctx context.Context, req *empty.Empty) (*api.ExportAccountResponse, error) {
+	userID := ctx.Value(user).(string)
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start export: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// the user row is locked so two requests can't both queue a job
+	if _, err = tx.Exec(ctx, `SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start export: %v", err)
+	}
+	row := tx.QueryRow(ctx, `
+		SELECT `+exportJobColumns+`
+		FROM export_jobs
+		WHERE user_id = $1
+		AND status IN ($2, $3)
+	`, userID, exportPending, exportRunning)
+	job, err := scanExportJob(row)
+	if err == nil {
+		return &api.ExportAccountResponse{Job: job, Message: "an export is already in progress"}, nil
+	}
+	if err != pgx.ErrNoRows {
+		return nil, status.Errorf(codes.Internal, "failed to start export: %v", err)
+	}
+
+	row = tx.QueryRow(ctx, `
+		INSERT INTO export_jobs (user_id)
+		VALUES ($1)
+		RETURNING `+exportJobColumns,
+		userID,
+	)
+	if job, err = scanExportJob(row); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start export: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start export: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{subject: job.Id, action: auditExportAccount, outcome: auditSuccess, detail: "queued"})
+
+	return &api.ExportAccountResponse{Job: job, Message: "export started, check its status to download it once it is ready"}, nil
+}
+
+func (s *ApiServer) GetExportJob(ctx context.Context, req *api.GetExportJobRequest) (*api.GetExportJobResponse, error) {
+	userID := ctx.Value(user).(string)
+	if req.JobId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "job id is required")
+	}
+
+	row := s.db.conn.QueryRow(ctx, `
+		SELECT `+exportJobColumns+`
+		FROM export_jobs
+		WHERE id = $1
+		AND user_id = $2
+	`, req.JobId, userID)
+	job, err := scanExportJob(row)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "export not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to retrieve export: %v", err)
+	}
+
+	return &api.GetExportJobResponse{Job: job, Message: fmt.Sprintf("export %s", strings.ToLower(strings.TrimPrefix(job.Status.String(), "EXPORT_JOB_STATUS_")))}, nil
+}
+
+func (s *ApiServer) DownloadExport(ctx context.Context, req *api.DownloadExportRequest) (*httpbody.HttpBody, error) {
+	userID := ctx.Value(user).(string)
+	if req.JobId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "job id is required")
+	}
+
+	var (
+		state   string
+		archive []byte
+	)
+	err := s.db.conn.QueryRow(ctx, `
+		SELECT status, archive
+		FROM export_jobs
+		WHERE id = $1
+		AND user_id = $2
+		AND (expires_at IS NULL OR expires_at > now())
+	`, req.JobId, userID).Scan(&state, &archive)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "export not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to download export: %v", err)
+	}
+	if state != exportReady {
+		return nil, status.Errorf(codes.FailedPrecondition, "export is %s, not ready", state)
+	}
+
+	// the gateway passes the header on, so browsers save the archive
+	disposition := fmt.Sprintf(`attachment; filename="tracker-export-%s.zip"`, req.JobId)
+	if err = grpc.SetHeader(ctx, metadata.Pairs("content-disposition", disposition)); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to download export: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{subject: req.JobId, action: auditExportAccount, outcome: auditSuccess, detail: "downloaded"})
+
+	return &httpbody.HttpBody{ContentType: "application/zip", Data: archive}, nil
+}
+
+// runExportWorker builds the queued exports one after the other until ctx is
+// done, and deletes the expired ones.
+func (s *ApiServer) runExportWorker(ctx context.Context) {
+	ticker := time.NewTicker(exportPollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			ran, err := s.runNextExport(ctx)
+			if err != nil {
+				log.Printf("failed to run export: %v", err)
+			}
+			if !ran {
+				break
+			}
+		}
+		if _, err := s.db.conn.Exec(ctx, `DELETE FROM export_jobs WHERE expires_at < now()`); err != nil {
+			log.Printf("failed to delete expired exports: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runNextExport claims the oldest queued job and runs it, it reports whether
+// there was one.
+func (s *ApiServer) runNextExport(ctx context.Context) (bool, error) {
+	var jobID, userID string
+	err := s.db.conn.QueryRow(ctx, `
+		UPDATE export_jobs
+		SET status = $1, started_at = now()
+		WHERE id = (
+			SELECT id
+			FROM export_jobs
+			WHERE status = $2
+			OR (status = $1 AND started_at < now() - $3::interval)
+			ORDER BY created_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, user_id
+	`, exportRunning, exportPending, exportStaleAfter).Scan(&jobID, &userID)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	archive, err := s.buildExportArchive(ctx, userID)
+	if err != nil {
+		log.Printf("failed to build export %s: %v", jobID, err)
+		_, err = s.db.conn.Exec(ctx, `
+			UPDATE export_jobs
+			SET status = $2, error = 'the export could not be built, please try again', completed_at = now(), expires_at = now() + $3::interval
+			WHERE id = $1
+		`, jobID, exportFailed, exportTTL)
+		return true, err
+	}
+	_, err = s.db.conn.Exec(ctx, `
+		UPDATE export_jobs
+		SET status = $2, archive = $3, completed_at = now(), expires_at = now() + $4::interval
+		WHERE id = $1
+	`, jobID, exportReady, archive, exportTTL)
+	return true, err
+}
+
+// exportMembership is a group the user belongs to, in groups.json.
+type exportMembership struct {
+	Group      json.RawMessage `json:"group"`
+	Permission string          `json:"permission"`
+	JoinedAt   time.Time       `json:"joinedAt"`
+}
+
+// buildExportArchive returns a zip of the user's profile, tickets and groups
+// as JSON, with a Markdown file per ticket for reading.
+func (s *ApiServer) buildExportArchive(ctx context.Context, userID string) ([]byte, error) {
+	// one snapshot, so the files agree with each other
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	row := tx.QueryRow(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, userID)
+	u, err := scanUser(row)
+	if err != nil {
+		return nil, err
+	}
+
+	tickets, err := exportTickets(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	memberships, err := exportMemberships(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	write := func(name string, data []byte) error {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	marshal := protojson.MarshalOptions{Indent: "  ", EmitUnpopulated: true}
+
+	profile, err := marshal.Marshal(u.toProto())
+	if err != nil {
+		return nil, err
+	}
+	if err = write("profile.json", profile); err != nil {
+		return nil, err
+	}
+
+	ticketsJSON := make([]json.RawMessage, 0, len(tickets))
+	for _, t := range tickets {
+		b, err := marshal.Marshal(t)
+		if err != nil {
+			return nil, err
+		}
+		ticketsJSON = append(ticketsJSON, b)
+		if err = write("tickets/"+t.Id+".md", ticketMarkdown(t)); err != nil {
+			return nil, err
+		}
+	}
+	b, err := json.MarshalIndent(ticketsJSON, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = write("tickets.json", b); err != nil {
+		return nil, err
+	}
+
+	if b, err = json.MarshalIndent(memberships, "", "  "); err != nil {
+		return nil, err
+	}
+	if err = write("groups.json", b); err != nil {
+		return nil, err
+	}
+
+	readme := fmt.Sprintf("# Practice tracker export\n\nExport of %s made on %s.\n\n"+
+		"- profile.json: your account\n- tickets.json: your %d tickets, tickets/ has them as Markdown\n- groups.json: the %d groups you are a member of\n",
+		u.email, time.Now().UTC().Format(time.RFC1123), len(tickets), len(memberships))
+	if err = write("README.md", []byte(readme)); err != nil {
+		return nil, err
+	}
+
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// exportTickets returns every ticket of the user with its taxonomies,
+// deleted tickets included.
+func exportTickets(ctx context.Context, tx pgx.Tx, userID string) ([]*api.Ticket, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT id, user_id, COALESCE(topic, ''), COALESCE(repo, ''), COALESCE(status_info, ''), COALESCE(summary, ''), created_at, deleted_at
+		FROM tickets
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tickets []*api.Ticket
+	byID := map[string]*api.Ticket{}
+	for rows.Next() {
+		var (
+			t       api.Ticket
+			created time.Time
+			deleted sql.NullTime
+		)
+		if err = rows.Scan(&t.Id, &t.UserId, &t.Topic, &t.Repo, &t.StatusInfo, &t.Summary, &created, &deleted); err != nil {
+			return nil, err
+		}
+		t.CreatedAt = timestamppb.New(created)
+		if deleted.Valid {
+			t.DeletedAt = timestamppb.New(deleted.Time)
+		}
+		tickets = append(tickets, &t)
+		byID[t.Id] = &t
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, tax := range ticketTaxonomies {
+		rows, err := tx.Query(ctx, fmt.Sprintf(`
+			SELECT link.ticket_id, COALESCE(names.%[4]s, '')
+			FROM %[1]s link
+			JOIN %[3]s names ON names.id = link.%[2]s
+			JOIN tickets ON tickets.id = link.ticket_id
+			WHERE tickets.user_id = $1
+			AND link.deleted_at IS NULL
+			ORDER BY link.created_at
+		`, tax.link, tax.idColumn, tax.table, tax.nameColumn), userID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var ticketID, name string
+			if err = rows.Scan(&ticketID, &name); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if t, ok := byID[ticketID]; ok {
+				names := tax.field(t)
+				*names = append(*names, name)
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return tickets, nil
+}
+
+// exportMemberships returns the groups the user is or was a member of.
+func exportMemberships(ctx context.Context, tx pgx.Tx, userID string) ([]exportMembership, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT groups.id, groups.user_id, COALESCE(groups.group_name, ''), COALESCE(groups.descript, ''), groups.created_at, groups.deleted_at,
+			COALESCE(group_users.permission, ''), group_users.created_at
+		FROM group_users
+		JOIN groups ON groups.id = group_users.group_id
+		WHERE group_users.user_id = $1
+		ORDER BY group_users.created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []exportMembership{}
+	for rows.Next() {
+		var (
+			group   api.Group
+			created time.Time
+			deleted sql.NullTime
+			m       exportMembership
+		)
+		if err = rows.Scan(&group.Id, &group.UserId, &group.Name, &group.Description, &created, &deleted, &m.Permission, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		group.CreatedAt = timestamppb.New(created)
+		if deleted.Valid {
+			group.DeletedAt = timestamppb.New(deleted.Time)
+		}
+		if m.Group, err = protojson.Marshal(&group); err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, m)
+	}
+	return memberships, rows.Err()
+}
+
+func ticketMarkdown(t *api.Ticket) []byte {
+	var b strings.Builder
+	title := t.Topic
+	if title == "" {
+		title = t.Id
+	}
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	fmt.Fprintf(&b, "- Status: %s\n", t.StatusInfo)
+	fmt.Fprintf(&b, "- Repository: %s\n", t.Repo)
+	fmt.Fprintf(&b, "- Created: %s\n", t.CreatedAt.AsTime().Format(time.RFC1123))
+	if t.DeletedAt != nil {
+		fmt.Fprintf(&b, "- Deleted: %s\n", t.DeletedAt.AsTime().Format(time.RFC1123))
+	}
+	if t.Summary != "" {
+		fmt.Fprintf(&b, "\n## Summary\n\n%s\n", t.Summary)
+	}
+	for _, section := range []struct {
+		title string
+		names []string
+	}{
+		{"Languages", t.Languages},
+		{"Technologies", t.Technologies},
+		{"YouTube channels", t.YtChannels},
+		{"Resources", t.Resources},
+		{"Sources", t.Sources},
+		{"Docs", t.Docs},
+	} {
+		if len(section.names) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n", section.title)
+		for _, name := range section.names {
+			fmt.Fprintf(&b, "- %s\n", name)
+		}
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (s *ApiServer) StartImpersonation(ctx context.Context, req *api.StartImpersonationRequest) (*api.StartImpersonationResponse, error) {
+	adminID := ctx.Value(user).(string)
+	sessionID, ok := ctx.Value(session).(string)
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "impersonation needs a session, it can't be started with an api key")
+	}
+	if req.UserId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user id is required")
+	}
+	if req.UserId == adminID {
+		return nil, status.Errorf(codes.InvalidArgument, "you can't impersonate yourself")
+	}
+
+	row := s.db.conn.QueryRow(ctx, `
+		SELECT `+userColumns+`
+		FROM users
+		WHERE id = $1
+		AND deleted_at IS NULL
+	`, req.UserId)
+	target, err := scanUser(row)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to start impersonation: %v", err)
+	}
+	// acting as another admin would hide who really did something
+	if roleFromUserType(target.userType) >= api.Role_ROLE_ADMIN {
+		return nil, status.Errorf(codes.PermissionDenied, "admins can't be impersonated")
+	}
+
+	// the token belongs to the admin's session, so revoking that session or
+	// logging out ends the impersonation too
+	token, expires, err := s.tokens.impersonate(target.id, sessionID, adminID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start impersonation: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{subject: target.id, action: auditStartImpersonation, outcome: auditSuccess})
+
+	return &api.StartImpersonationResponse{
+		User:                 target.toProto(),
+		AccessToken:          token,
+		AccessTokenExpiresAt: timestamppb.New(expires),
+		Message:              fmt.Sprintf("impersonating %s until %s", target.email, expires.UTC().Format("15:04 MST")),
+	}, nil
+}
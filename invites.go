@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// In invite mode (REGISTRATION_MODE=invite) CreateAccount only accepts an
+// invite code made by an admin with CreateInvite. In open mode anybody can
+// register, an invite code still grants its user type and group.
+const (
+	registrationOpen   = "open"
+	registrationInvite = "invite"
+)
+
+const (
+	defaultInviteTTL = 7 * 24 * time.Hour
+	// the permission of group members that joined with an invite
+	groupPermissionMember = "member"
+)
+
+var errInvalidInvite = status.Errorf(codes.PermissionDenied, "invalid or expired invite code")
+
+type inviteRecord struct {
+	id        string
+	createdBy sql.NullString
+	maxUses   int32
+	uses      int32
+	userType  sql.NullString
+	groupID   sql.NullString
+	expiresAt time.Time
+	createdAt time.Time
+}
+
+const inviteColumns = `id, created_by, max_uses, uses, user_type, group_id, expires_at, created_at`
+
+func scanInvite(row pgx.Row) (*inviteRecord, error) {
+	var i inviteRecord
+	err := row.Scan(&i.id, &i.createdBy, &i.maxUses, &i.uses, &i.userType, &i.groupID, &i.expiresAt, &i.createdAt)
+	if err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
+
+func (i *inviteRecord) toProto() *api.Invite {
+	return &api.Invite{
+		Id:        i.id,
+		CreatedBy: i.createdBy.String,
+		MaxUses:   i.maxUses,
+		Uses:      i.uses,
+		UserType:  i.userType.String,
+		GroupId:   i.groupID.String,
+		ExpiresAt: timestamppb.New(i.expiresAt.Truncate(60 * time.Second)),
+		CreatedAt: timestamppb.New(i.createdAt.Truncate(60 * time.Second)),
+	}
+}
+
+// consumeInvite takes one use of the invite. The row is locked by the update
+// until tx ends, so concurrent registrations can't go over max_uses, and a
+// failed registration gives the use back when tx is rolled back.
+func consumeInvite(ctx context.Context, tx pgx.Tx, code string) (*inviteRecord, error) {
+	row := tx.QueryRow(ctx, `
+		UPDATE invites
+		SET uses = uses + 1
+		WHERE code_hash = $1
+		AND uses < max_uses
+		AND expires_at > now()
+		AND (group_id IS NULL OR group_id IN (SELECT id FROM groups WHERE deleted_at IS NULL))
+		RETURNING `+inviteColumns,
+		hashToken(code),
+	)
+	invite, err := scanInvite(row)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, errInvalidInvite
+		}
+		return nil, status.Errorf(codes.Internal, "failed to redeem invite: %v", err)
+	}
+	return invite, nil
+}
+
+func (s *ApiServer) CreateInvite(ctx context.Context, req *api.CreateInviteRequest) (*api.CreateInviteResponse, error) {
+	adminID := ctx.Value(user).(string)
+	if req.MaxUses < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "max uses can't be negative")
+	}
+	maxUses := req.MaxUses
+	if maxUses == 0 {
+		maxUses = 1
+	}
+	expiresAt := time.Now().Add(defaultInviteTTL)
+	if req.ExpiresAt != nil {
+		if err := req.ExpiresAt.CheckValid(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid expires at: %v", err)
+		}
+		expiresAt = req.ExpiresAt.AsTime()
+		if !expiresAt.After(time.Now()) {
+			return nil, status.Errorf(codes.InvalidArgument, "expires at must be in the future")
+		}
+	}
+	userType := sql.NullString{String: req.UserType, Valid: req.UserType != ""}
+	if userType.Valid && roleFromUserType(req.UserType) == api.Role_ROLE_UNSPECIFIED {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown user type %q", req.UserType)
+	}
+	groupID := sql.NullString{String: req.GroupId, Valid: req.GroupId != ""}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create invite: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if groupID.Valid {
+		var exists bool
+		err = tx.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM groups WHERE id = $1 AND deleted_at IS NULL)
+		`, groupID).Scan(&exists)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create invite: %v", err)
+		}
+		if !exists {
+			return nil, status.Errorf(codes.NotFound, "group not found")
+		}
+	}
+
+	code := genRandomBytesHex(20)
+	row := tx.QueryRow(ctx, `
+		INSERT INTO invites (code_hash, created_by, max_uses, user_type, group_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, now() + $6::interval)
+		RETURNING `+inviteColumns,
+		hashToken(code),
+		adminID,
+		maxUses,
+		userType,
+		groupID,
+		time.Until(expiresAt),
+	)
+	invite, err := scanInvite(row)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create invite: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create invite: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{subject: invite.id, action: auditCreateInvite, outcome: auditSuccess})
+
+	return &api.CreateInviteResponse{
+		Invite:  invite.toProto(),
+		Code:    code,
+		Message: fmt.Sprintf("invite %s created for %d registrations", invite.id, invite.maxUses),
+	}, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// localConn is a grpc.ClientConnInterface that calls the server in-process.
+// The gateway uses it instead of calling the ApiServer directly so that the
+// same unary interceptors run for http requests as for grpc requests, without
+// going through the network.
+type localConn struct {
+	srv         interface{}
+	desc        *grpc.ServiceDesc
+	interceptor grpc.UnaryServerInterceptor
+}
+
+func newLocalConn(srv interface{}, desc *grpc.ServiceDesc, interceptors ...grpc.UnaryServerInterceptor) *localConn {
+	return &localConn{
+		srv,
+		desc,
+		chainInterceptors(interceptors),
+	}
+}
+
+func (c *localConn) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	name := method[strings.LastIndex(method, "/")+1:]
+	var desc *grpc.MethodDesc
+	for i := range c.desc.Methods {
+		if c.desc.Methods[i].MethodName == name {
+			desc = &c.desc.Methods[i]
+			break
+		}
+	}
+	if desc == nil {
+		return status.Errorf(codes.Unimplemented, "unknown method %s", method)
+	}
+
+	// the gateway sends the request headers as outgoing metadata, the
+	// endpoints expect to find them in the incoming metadata
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
+	stream := &localStream{method: method}
+	ctx = grpc.NewContextWithServerTransportStream(ctx, stream)
+
+	dec := func(in interface{}) error {
+		proto.Merge(in.(proto.Message), args.(proto.Message))
+		return nil
+	}
+	res, err := desc.Handler(c.srv, ctx, dec, c.interceptor)
+
+	for _, o := range opts {
+		switch o := o.(type) {
+		case grpc.HeaderCallOption:
+			*o.HeaderAddr = stream.header
+		case grpc.TrailerCallOption:
+			*o.TrailerAddr = stream.trailer
+		}
+	}
+	if err != nil {
+		return err
+	}
+	proto.Merge(reply.(proto.Message), res.(proto.Message))
+	return nil
+}
+
+func (c *localConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return nil, status.Errorf(codes.Unimplemented, "streaming is not supported in-process")
+}
+
+// chainInterceptors turns the interceptors into one, the first one being the
+// outermost, like grpc.ChainUnaryInterceptor does for the grpc server.
+func chainInterceptors(interceptors []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	if len(interceptors) == 0 {
+		return nil
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, inner)
+			}
+		}
+		return next(ctx, req)
+	}
+}
+
+// localStream collects the metadata the endpoints set with grpc.SetHeader
+// and grpc.SetTrailer so it can be passed back to the gateway.
+type localStream struct {
+	mu      sync.Mutex
+	method  string
+	header  metadata.MD
+	trailer metadata.MD
+}
+
+func (s *localStream) Method() string {
+	return s.method
+}
+
+func (s *localStream) SetHeader(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *localStream) SendHeader(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+func (s *localStream) SetTrailer(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trailer = metadata.Join(s.trailer, md)
+	return nil
+}
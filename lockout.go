@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Failed logins are counted per account and per client ip in the
+// login_throttle table. Once a key reaches its limit it is locked, and every
+// further failure doubles the lockout up to cfg.maxLockout. Failures older
+// than failureWindow are forgotten.
+const (
+	accountMaxFailures = 5
+	ipMaxFailures      = 20
+	failureWindow      = time.Hour
+)
+
+func accountThrottleKey(userID string) string {
+	return "user:" + userID
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// clientIP returns the address of the caller. grpc requests have a peer, the
+// gateway requests come through the localConn and carry the address the
+// gateway appended to x-forwarded-for.
+func clientIP(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	forwarded := md.Get("x-forwarded-for")
+	if len(forwarded) == 0 {
+		return ""
+	}
+	hops := strings.Split(forwarded[len(forwarded)-1], ",")
+	return strings.TrimSpace(hops[len(hops)-1])
+}
+
+// throttleKeys returns the keys a login attempt is counted under.
+func throttleKeys(ctx context.Context, userID string) []string {
+	var keys []string
+	if userID != "" {
+		keys = append(keys, accountThrottleKey(userID))
+	}
+	if ip := clientIP(ctx); ip != "" {
+		keys = append(keys, ipThrottleKey(ip))
+	}
+	return keys
+}
+
+// checkLockout returns a ResourceExhausted error with the time left when any
+// of the keys is locked.
+func (s *ApiServer) checkLockout(ctx context.Context, keys ...string) error {
+	var seconds float64
+	err := s.db.conn.QueryRow(ctx, `
+		SELECT COALESCE(EXTRACT(EPOCH FROM max(locked_until) - now()), 0)
+		FROM login_throttle
+		WHERE key = ANY($1)
+		AND locked_until > now()
+	`, keys).Scan(&seconds)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+	if seconds <= 0 {
+		return nil
+	}
+
+	retry := time.Duration(seconds * float64(time.Second)).Round(time.Second)
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf("too many failed login attempts, try again in %s", retry))
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retry)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// recordLoginFailure counts a failed attempt for the key and locks it once it
+// is over the limit. It runs outside of the login transaction, which is rolled
+// back on failure.
+func (s *ApiServer) recordLoginFailure(ctx context.Context, key string, maxFailures int) error {
+	var failures int
+	err := s.db.conn.QueryRow(ctx, `
+		INSERT INTO login_throttle (key, failures, last_failure_at)
+		VALUES ($1, 1, now())
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE
+				WHEN login_throttle.last_failure_at < now() - $2::interval THEN 1
+				ELSE login_throttle.failures + 1
+			END,
+			last_failure_at = now()
+		RETURNING failures
+	`, key, failureWindow).Scan(&failures)
+	if err != nil || failures < maxFailures {
+		return err
+	}
+
+	lockout := s.cfg.lockout
+	for i := maxFailures; i < failures && lockout < s.cfg.maxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > s.cfg.maxLockout {
+		lockout = s.cfg.maxLockout
+	}
+	_, err = s.db.conn.Exec(ctx, `
+		UPDATE login_throttle
+		SET locked_until = now() + $2::interval
+		WHERE key = $1
+	`, key, lockout)
+	return err
+}
+
+// loginFailed records the failure for the account, when it is known, and for
+// the client ip.
+func (s *ApiServer) loginFailed(ctx context.Context, userID string) error {
+	if userID != "" {
+		if err := s.recordLoginFailure(ctx, accountThrottleKey(userID), accountMaxFailures); err != nil {
+			return err
+		}
+	}
+	if ip := clientIP(ctx); ip != "" {
+		return s.recordLoginFailure(ctx, ipThrottleKey(ip), ipMaxFailures)
+	}
+	return nil
+}
+
+// loginSucceeded forgets the failures of the account. The failures of the ip
+// are kept so a valid login can't be used to reset them.
+func loginSucceeded(ctx context.Context, tx pgx.Tx, userID string) error {
+	_, err := tx.Exec(ctx, `DELETE FROM login_throttle WHERE key = $1`, accountThrottleKey(userID))
+	return err
+}
+
+func (s *ApiServer) UnlockAccount(ctx context.Context, req *api.UnlockAccountRequest) (*api.UnlockAccountResponse, error) {
+	if req.UserId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user id is required")
+	}
+
+	var exists bool
+	err := s.db.conn.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, req.UserId).Scan(&exists)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unlock account: %v", err)
+	}
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+
+	if _, err = s.db.conn.Exec(ctx, `DELETE FROM login_throttle WHERE key = $1`, accountThrottleKey(req.UserId)); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unlock account: %v", err)
+	}
+
+	s.db.recordAudit(ctx, auditEvent{subject: req.UserId, action: auditUnlockAccount, outcome: auditSuccess})
+
+	return &api.UnlockAccountResponse{Message: fmt.Sprintf("account %s unlocked", req.UserId)}, nil
+}
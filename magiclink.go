@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// A magic link logs in whoever opens it, in the browser that asked for it.
+// RequestMagicLink sets a random nonce in a cookie and only its hash is kept
+// with the link, so a link that leaks from the mailbox can't be used
+// elsewhere. Links work once and expire after cfg.magicLinkTTL.
+const (
+	authMethodMagicLink = "magic_link"
+
+	magicLinkCookie = "magic_link_nonce"
+	magicLinkPath   = "/v1/magic-login"
+)
+
+// setMagicLinkCookie sends the cookie through the gateway, maxAge -1 removes it.
+func (s *ApiServer) setMagicLinkCookie(ctx context.Context, value string, maxAge int) error {
+	cookie := &http.Cookie{
+		Name:     magicLinkCookie,
+		Value:    value,
+		Path:     magicLinkPath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.cfg.publicURL, "https://"),
+		// the link is opened from the mail client, lax still sends the
+		// cookie for that top level navigation
+		SameSite: http.SameSiteLaxMode,
+	}
+	return grpc.SetHeader(ctx, metadata.Pairs("set-cookie", cookie.String()))
+}
+
+// magicLinkNonce reads the nonce cookie, grpc clients send it as cookie
+// metadata.
+func magicLinkNonce(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	r := http.Request{Header: http.Header{"Cookie": append(md.Get("grpcgateway-cookie"), md.Get("cookie")...)}}
+	cookie, err := r.Cookie(magicLinkCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+func (s *ApiServer) RequestMagicLink(ctx context.Context, req *api.RequestMagicLinkRequest) (*api.RequestMagicLinkResponse, error) {
+	if req.Email == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "email is required")
+	}
+	// the same answer for every address, so the endpoint can't be used to
+	// find out who has an account
+	res := &api.RequestMagicLinkResponse{Message: fmt.Sprintf("if %s belongs to an account, a sign-in link was sent to it", req.Email)}
+
+	nonce := genRandomBytesHex(20)
+	if err := s.setMagicLinkCookie(ctx, nonce, int(s.cfg.magicLinkTTL.Seconds())); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to send sign-in link: %v", err)
+	}
+
+	// one statement either way, and the mail is sent in the background, so
+	// the response time doesn't tell whether the account exists
+	token := genRandomBytesHex(20)
+	var email string
+	err := s.db.conn.QueryRow(ctx, `
+		INSERT INTO magic_links (user_id, token_hash, nonce_hash, expires_at)
+		SELECT id, $2, $3, now() + $4::interval
+		FROM users
+		WHERE email = $1
+		AND deleted_at IS NULL
+		RETURNING (SELECT email FROM users WHERE users.id = magic_links.user_id)
+	`, req.Email, hashToken(token), hashToken(nonce), s.cfg.magicLinkTTL).Scan(&email)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, status.Errorf(codes.Internal, "failed to send sign-in link: %v", err)
+	}
+
+	if err == nil {
+		go func() {
+			if err := s.sendMagicLinkEmail(context.Background(), email, token); err != nil {
+				log.Printf("failed to send sign-in link to %s: %v", email, err)
+			}
+		}()
+	}
+
+	return res, nil
+}
+
+func (s *ApiServer) sendMagicLinkEmail(ctx context.Context, email, token string) error {
+	link := s.cfg.publicURL + magicLinkPath + "?token=" + url.QueryEscape(token)
+	return s.mailer.Send(ctx, mail{
+		To:      email,
+		Subject: "Your sign-in link",
+		Body: fmt.Sprintf(
+			"Open the link below in the browser you asked for it from to sign in to your practice tracker account:\n\n%s\n\nThe link works once and expires in %s. If you didn't ask for it, you can ignore this email.\n",
+			link,
+			s.cfg.magicLinkTTL,
+		),
+	})
+}
+
+// MagicLogin redeems the link and logs in like Login, including the second
+// factor when it is enabled.
+func (s *ApiServer) MagicLogin(ctx context.Context, req *api.MagicLoginRequest) (*api.LoginResponse, error) {
+	if req.Token == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "token is required")
+	}
+	nonce := magicLinkNonce(ctx)
+	if nonce == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "open the sign-in link in the browser you asked for it from")
+	}
+	if err := s.checkLockout(ctx, throttleKeys(ctx, "")...); err != nil {
+		s.db.recordAudit(ctx, auditEvent{action: auditLogin, outcome: auditDenied, detail: "locked out"})
+		return nil, err
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// the nonce is part of the match, opening the link in another browser
+	// doesn't use it up
+	var userID string
+	err = tx.QueryRow(ctx, `
+		UPDATE magic_links
+		SET used_at = now()
+		WHERE token_hash = $1
+		AND nonce_hash = $2
+		AND used_at IS NULL
+		AND expires_at > now()
+		RETURNING user_id
+	`, hashToken(req.Token), hashToken(nonce)).Scan(&userID)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		s.db.recordAudit(ctx, auditEvent{action: auditLogin, outcome: auditFailure, detail: "invalid magic link"})
+		if err = s.loginFailed(ctx, ""); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "invalid or expired sign-in link, or it was opened in another browser")
+	}
+
+	row := tx.QueryRow(ctx, `
+		SELECT `+userColumns+`
+		FROM users
+		WHERE id = $1
+		FOR UPDATE
+	`, userID)
+	user, err := scanUser(row)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+	if err = s.checkLockout(ctx, accountThrottleKey(user.id)); err != nil {
+		s.db.recordAudit(ctx, auditEvent{actorID: user.id, subject: user.email, action: auditLogin, outcome: auditDenied, detail: "locked out"})
+		return nil, err
+	}
+	if user.deletedAt.Valid {
+		s.db.recordAudit(ctx, auditEvent{actorID: user.id, subject: user.email, action: auditLogin, outcome: auditDenied, detail: "account deleted"})
+		return nil, errAccountDeleted(user.id, s.purgeAt(user.deletedAt.Time))
+	}
+	if s.cfg.approvalRequired && !user.activatedAt.Valid {
+		s.db.recordAudit(ctx, auditEvent{actorID: user.id, subject: user.email, action: auditLogin, outcome: auditDenied, detail: "waiting for approval"})
+		return nil, errAccountInactive(user.id)
+	}
+
+	// The link was opened from the mailbox, which proves the address. Like
+	// with oidcLogin, whoever registered it unverified with a password loses
+	// the password and their sessions to its owner.
+	if !user.emailVerified {
+		if _, err = tx.Exec(ctx, `
+			UPDATE users
+			SET email_verified = true, password = NULL, email_verify_token = NULL, email_verify_token_expires = NULL
+			WHERE id = $1
+		`, user.id); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		if err = revokeUserSessions(ctx, tx, user.id); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		user.emailVerified = true
+		user.password.Valid = false
+	}
+	if user.authMethod.String != authMethodMagicLink {
+		if _, err = tx.Exec(ctx, `
+			UPDATE users
+			SET auth_method = $2
+			WHERE id = $1
+		`, user.id, authMethodMagicLink); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		user.authMethod.String, user.authMethod.Valid = authMethodMagicLink, true
+	}
+
+	if err = s.setMagicLinkCookie(ctx, "", -1); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+
+	enabled, err := totpEnabled(ctx, tx, user.id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+	if enabled {
+		challenge, err := s.newLoginChallenge(user.id)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		if err = tx.Commit(ctx); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		return &api.LoginResponse{Message: "enter the code of your authenticator app to finish logging in", TotpRequired: true, ChallengeToken: challenge}, nil
+	}
+
+	if err = loginSucceeded(ctx, tx, user.id); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+
+	tokens, err := s.newSession(ctx, tx, user.id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{actorID: user.id, subject: user.email, action: auditLogin, outcome: auditSuccess, detail: "magic link"})
+
+	return &api.LoginResponse{User: user.toProto(), Message: fmt.Sprintf("user %s successfully logged in", user.email), Tokens: tokens}, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mail is a plain text email sent to a single recipient.
+type mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// mailer delivers outgoing emails. The server only depends on this interface
+// so the smtp delivery can be swapped for a local sink in development.
+type mailer interface {
+	Send(ctx context.Context, m mail) error
+}
+
+// newMailer picks the mailer from the MAILER env variable, "smtp" or "file".
+// There is no default, the file mailer keeps the tokens of the mails in plain
+// text on disk and is only meant for development.
+func newMailer(kind string) (mailer, error) {
+	switch kind {
+	case "":
+		return nil, fmt.Errorf("MAILER unset, set it to smtp or file")
+	case "smtp":
+		addr := os.Getenv("SMTP_ADDR")
+		if addr == "" {
+			return nil, fmt.Errorf("SMTP_ADDR unset")
+		}
+		from := os.Getenv("MAIL_FROM")
+		if from == "" {
+			return nil, fmt.Errorf("MAIL_FROM unset")
+		}
+		var auth smtp.Auth
+		if username := os.Getenv("SMTP_USERNAME"); username != "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SMTP_ADDR: %v", err)
+			}
+			auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		return &smtpMailer{addr, from, auth}, nil
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "./mail"
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+		return &fileMailer{dir}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", kind)
+	}
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *smtpMailer) Send(ctx context.Context, msg mail) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, formatMail(m.from, msg))
+}
+
+// fileMailer writes every message into its own .eml file inside dir.
+type fileMailer struct {
+	dir string
+}
+
+func (m *fileMailer) Send(ctx context.Context, msg mail) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), genRandomBytesHex(4))
+	return os.WriteFile(filepath.Join(m.dir, name), formatMail("tracker@localhost", msg), 0o600)
+}
+
+func formatMail(from string, msg mail) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
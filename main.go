@@ -2,15 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/protobuf/encoding/protojson"
 
 	api "github.com/HasmikAtom/tracker/v1"
@@ -22,6 +28,15 @@ var (
 )
 
 func main() {
+	// tracker build-breached-list <list> <output> turns a list of breached
+	// passwords or their SHA-1 hashes into the file BREACHED_PASSWORDS expects
+	if len(os.Args) == 4 && os.Args[1] == "build-breached-list" {
+		if err := buildBreachedList(os.Args[2], os.Args[3]); err != nil {
+			log.Fatal("error building the breached password list: ", err)
+		}
+		return
+	}
+
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -45,35 +60,188 @@ func main() {
 	}
 	db := newDatabase(conn)
 
+	sessionSecret := os.Getenv("SESSION_SECRET")
+	if len(sessionSecret) < 32 {
+		log.Fatal("SESSION_SECRET must be at least 32 characters")
+	}
+	tokens := newTokenSigner([]byte(sessionSecret), envDuration("SESSION_TTL", 15*time.Minute))
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8000"
+	}
+
+	cfg := serverConfig{
+		publicURL:        os.Getenv("PUBLIC_URL"),
+		refreshTTL:       envDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		emailVerifyTTL:   envDuration("EMAIL_VERIFY_TTL", 48*time.Hour),
+		resetTTL:         envDuration("PASSWORD_RESET_TTL", time.Hour),
+		resetURL:         os.Getenv("RESET_URL"),
+		magicLinkTTL:     envDuration("MAGIC_LINK_TTL", 15*time.Minute),
+		lockout:          envDuration("LOGIN_LOCKOUT", time.Minute),
+		maxLockout:       envDuration("LOGIN_MAX_LOCKOUT", time.Hour),
+		approvalRequired: envBool("APPROVAL_REQUIRED", false),
+		registrationMode: envString("REGISTRATION_MODE", registrationOpen),
+		deletionGrace:    envDuration("ACCOUNT_DELETION_GRACE", 30*24*time.Hour),
+		purgeInterval:    envDuration("ACCOUNT_PURGE_INTERVAL", time.Hour),
+	}
+	if cfg.registrationMode != registrationOpen && cfg.registrationMode != registrationInvite {
+		log.Fatalf("invalid REGISTRATION_MODE %q, must be %s or %s", cfg.registrationMode, registrationOpen, registrationInvite)
+	}
+	if cfg.purgeInterval <= 0 {
+		log.Fatalf("invalid ACCOUNT_PURGE_INTERVAL %s, must be positive", cfg.purgeInterval)
+	}
+	if cfg.publicURL == "" {
+		cfg.publicURL = "http://localhost:" + port
+	}
+	if u, err := url.Parse(cfg.resetURL); err != nil || !u.IsAbs() {
+		log.Fatal("RESET_URL must be the absolute url of the page that asks for the new password")
+	}
+
+	mailer, err := newMailer(os.Getenv("MAILER"))
+	if err != nil {
+		log.Fatal("error setting up the mailer: ", err)
+	}
+
+	// two-factor authentication is only available with an encryption key for
+	// the totp secrets
+	var secrets *secretBox
+	if key := os.Getenv("TOTP_ENCRYPTION_KEY"); key != "" {
+		raw, err := hex.DecodeString(key)
+		if err != nil {
+			log.Fatal("TOTP_ENCRYPTION_KEY must be hex encoded: ", err)
+		}
+		if secrets, err = newSecretBox(raw); err != nil {
+			log.Fatal("invalid TOTP_ENCRYPTION_KEY: ", err)
+		}
+	}
+
+	passwords, err := newPasswordHasher(
+		envString("PASSWORD_HASH", passwordAlgorithmArgon2id),
+		envInt("BCRYPT_COST", 12),
+		argon2Params{
+			memory:  uint32(envInt("ARGON2_MEMORY", 64*1024)),
+			time:    uint32(envInt("ARGON2_TIME", 3)),
+			threads: uint8(envInt("ARGON2_THREADS", 2)),
+			saltLen: 16,
+			keyLen:  32,
+		},
+		// each argon2id hash in flight holds ARGON2_MEMORY KiB
+		envInt("PASSWORD_HASH_CONCURRENCY", 4),
+	)
+	if err != nil {
+		log.Fatal("error setting up password hashing: ", err)
+	}
+
+	var breached *bloomFilter
+	if path := os.Getenv("BREACHED_PASSWORDS"); path != "" {
+		if breached, err = readBloomFilter(path); err != nil {
+			log.Fatal("error loading the breached password list: ", err)
+		}
+	}
+	passwordPolicy := newPasswordPolicy(
+		envInt("PASSWORD_MIN_LENGTH", 10),
+		float64(envInt("PASSWORD_MIN_ENTROPY", 50)),
+		breached,
+	)
+
 	mux := runtime.NewServeMux(
-		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
-			MarshalOptions: protojson.MarshalOptions{
-				EmitUnpopulated: true,
-				UseProtoNames:   false,
+		// HTTPBodyMarshaler sends google.api.HttpBody responses like the
+		// account exports as they are
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.HTTPBodyMarshaler{
+			Marshaler: &runtime.JSONPb{
+				MarshalOptions: protojson.MarshalOptions{
+					EmitUnpopulated: true,
+					UseProtoNames:   false,
+				},
 			},
 		}),
 		runtime.WithIncomingHeaderMatcher(func(key string) (string, bool) {
 			switch key {
-			case "X-Atom-User":
+			case sessionHeader:
 				return key, true
 			default:
 				return runtime.DefaultHeaderMatcher(key)
 			}
 		}),
+		runtime.WithOutgoingHeaderMatcher(func(key string) (string, bool) {
+			switch key {
+			case "content-disposition", "set-cookie":
+				return key, true
+			default:
+				return runtime.MetadataHeaderPrefix + key, true
+			}
+		}),
 	)
 
-	grpcServer := newApiServer(db)
-	if err := api.RegisterApiHandlerServer(ctx, mux, grpcServer); err != nil {
-		log.Fatal(err)
+	// internal services can use client certificates on a TLS grpc listener
+	var (
+		grpcTLS  *tls.Config
+		services map[string]api.Role
+	)
+	if certFile := os.Getenv("GRPC_TLS_CERT"); certFile != "" {
+		grpcTLS, err = loadServerTLS(certFile, os.Getenv("GRPC_TLS_KEY"), os.Getenv("GRPC_CLIENT_CA"))
+		if err != nil {
+			log.Fatal("error setting up grpc TLS: ", err)
+		}
+		if services, err = parseServiceIdentities(os.Getenv("GRPC_SERVICE_IDENTITIES")); err != nil {
+			log.Fatal("invalid GRPC_SERVICE_IDENTITIES: ", err)
+		}
 	}
 
-	grpcAuthN := grpcAuthNFunc(ctx)
-	httpAuthN := httpAuthNFunc(ctx)
+	auth := newAuthenticator(db, tokens, cfg.approvalRequired, services)
+	grpcAuthN := grpcAuthNFunc(ctx, auth)
+	grpcAuthZ := grpcAuthZFunc(ctx, db)
+	httpAuthN := httpAuthNFunc(ctx, auth)
+
+	// the http requests are authenticated by httpAuthN before they reach the
+	// gateway, so only the authorization runs for them in-process
+	grpcServer := newApiServer(db, tokens, mailer, secrets, passwords, passwordPolicy, cfg)
+	localClient := api.NewApiClient(newLocalConn(grpcServer, &api.Api_ServiceDesc, grpcAuthZ))
+	if err := api.RegisterApiHandlerClient(ctx, mux, localClient); err != nil {
+		log.Fatal(err)
+	}
 
 	httpServer := http.NewServeMux()
 	httpServer.Handle("/", httpAuthN(mux))
 	httpServer.Handle("/v1/login", mux)
+	httpServer.Handle("/v1/login/complete", mux)
+	httpServer.Handle("/v1/magic-link", mux)
+	httpServer.Handle("/v1/magic-login", mux)
 	httpServer.Handle("/v1/register", mux)
+	httpServer.Handle("/v1/sessions/refresh", mux)
+	httpServer.Handle("/v1/logout", mux)
+	httpServer.Handle("/v1/verify-email", mux)
+	httpServer.Handle("/v1/password-reset", mux)
+	httpServer.Handle("/v1/password-reset/confirm", mux)
+	httpServer.Handle("/v1/account/restore", mux)
+	httpServer.Handle("/v1/email-change/confirm", mux)
+	httpServer.Handle("/v1/email-change/revert", mux)
+
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		oidcCfg := oidcConfig{
+			issuer:       issuer,
+			clientID:     os.Getenv("OIDC_CLIENT_ID"),
+			clientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			redirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+			scopes:       []string{"openid", "email", "profile"},
+		}
+		if oidcCfg.clientID == "" {
+			log.Fatal("OIDC_CLIENT_ID unset")
+		}
+		if oidcCfg.redirectURL == "" {
+			oidcCfg.redirectURL = cfg.publicURL + "/v1/oidc/callback"
+		}
+		if scopes := os.Getenv("OIDC_SCOPES"); scopes != "" {
+			oidcCfg.scopes = strings.Fields(scopes)
+		}
+		provider, err := newOIDCProvider(ctx, oidcCfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		httpServer.Handle("/v1/oidc/login", grpcServer.oidcLoginHandler(provider))
+		httpServer.Handle("/v1/oidc/callback", grpcServer.oidcCallbackHandler(provider))
+	}
 
 	fs := http.FileServer(http.Dir(swaggerFolderPath))
 	httpServer.Handle("/swaggerui/", http.StripPrefix("/swaggerui/", fs))
@@ -82,11 +250,6 @@ func main() {
 		http.ServeFile(w, r, swaggerFilePath)
 	})
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000"
-	}
-
 	l, err := net.Listen("tcp", ":"+port)
 	if err != nil {
 		log.Panic(err)
@@ -97,14 +260,72 @@ func main() {
 	grpcl := m.MatchWithWriters(
 		cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"),
 	)
+	// TLS can't be told apart by its content, so all of it goes to the
+	// grpc server that requires client certificates
+	var tlsl net.Listener
+	if grpcTLS != nil {
+		tlsl = m.Match(cmux.TLS())
+	}
 	httpl := m.Match(cmux.HTTP1Fast())
 
-	go serveGRPC(grpcl, grpcServer, grpcAuthN)
+	go serveGRPC(grpcl, grpcServer, nil, grpcAuthN, grpcAuthZ)
 	log.Println("started grpc server on port ", port)
+	if tlsl != nil {
+		go serveGRPC(tlsl, grpcServer, credentials.NewTLS(grpcTLS), grpcAuthN, grpcAuthZ)
+		log.Println("started grpc TLS server on port ", port)
+	}
 	go serveHTTP(httpl, httpServer)
 	log.Println("started http server on port ", port)
 
+	go grpcServer.runAccountPurger(ctx)
+	go grpcServer.runExportWorker(ctx)
+
 	if err := m.Serve(); !strings.Contains(err.Error(), "use of closed network connection") {
 		panic(err)
 	}
 }
+
+// envDuration reads a duration such as "15m" from the environment, falling
+// back to def when the variable is unset.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return d
+}
+
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return i
+}
+
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return b
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// Internal services can call the grpc api over TLS with a client certificate
+// signed by GRPC_CLIENT_CA instead of a user token. The common name of the
+// certificate is the name of the service, GRPC_SERVICE_IDENTITIES maps the
+// names that are accepted to their role, like "billing=user,ops=admin".
+// Without a user token a service only gets to call the rpcs whose policy
+// has allow_service, the rest act as a user and need one.
+
+// servicePrincipal is put in the context of requests made by a service.
+type servicePrincipal struct {
+	name string
+	role api.Role
+}
+
+// id is the actor of the audit events of the service.
+func (p *servicePrincipal) id() string {
+	return "svc:" + p.name
+}
+
+// loadServerTLS reads the server certificate and the CA the client
+// certificates have to be signed by.
+func loadServerTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the server certificate: %v", err)
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the client CA: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("the client CA file has no certificates")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2"},
+	}, nil
+}
+
+// parseServiceIdentities parses "<common name>=<role>" pairs separated by
+// commas.
+func parseServiceIdentities(v string) (map[string]api.Role, error) {
+	services := map[string]api.Role{}
+	for _, pair := range strings.Split(v, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid service identity %q, expected <common name>=<role>", pair)
+		}
+		role := roleFromUserType(strings.TrimSpace(parts[1]))
+		if role == api.Role_ROLE_UNSPECIFIED {
+			return nil, fmt.Errorf("invalid role for service %q", parts[0])
+		}
+		services[strings.TrimSpace(parts[0])] = role
+	}
+	return services, nil
+}
+
+// servicePrincipal returns the service behind the verified client certificate
+// of the connection, if there is one and its name is known.
+func (a *authenticator) servicePrincipal(ctx context.Context) (*servicePrincipal, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	name := info.State.VerifiedChains[0][0].Subject.CommonName
+	role, ok := a.services[name]
+	if !ok {
+		return nil, false
+	}
+	return &servicePrincipal{name, role}, true
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	api "github.com/HasmikAtom/tracker/v1"
+)
+
+func TestParseServiceIdentities(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  map[string]api.Role
+		ok    bool
+	}{
+		{"empty", "", map[string]api.Role{}, true},
+		{"one", "billing=user", map[string]api.Role{"billing": api.Role_ROLE_USER}, true},
+		{"several", "billing=user,backoffice=admin", map[string]api.Role{"billing": api.Role_ROLE_USER, "backoffice": api.Role_ROLE_ADMIN}, true},
+		{"spaces and empty pairs", " billing = user , ,backoffice=admin,", map[string]api.Role{"billing": api.Role_ROLE_USER, "backoffice": api.Role_ROLE_ADMIN}, true},
+		{"last one wins", "billing=user,billing=admin", map[string]api.Role{"billing": api.Role_ROLE_ADMIN}, true},
+		{"no role", "billing", nil, false},
+		{"empty role", "billing=", nil, false},
+		{"unknown role", "billing=root", nil, false},
+		{"no name", "=admin", nil, false},
+		{"role with equals", "billing=admin=user", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseServiceIdentities(tt.value)
+			if (err == nil) != tt.ok {
+				t.Fatalf("parseServiceIdentities(%q) error = %v, want ok %v", tt.value, err, tt.ok)
+			}
+			if tt.ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseServiceIdentities(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	authMethodPassword = "password"
+	authMethodOIDC     = "oidc"
+
+	oidcStateCookie = "oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+// oidcConfig is the client registration at the identity provider. Everything
+// else is read from the provider's discovery document.
+type oidcConfig struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+}
+
+// oidcProvider implements the authorization code flow with PKCE against any
+// OpenID Connect provider that supports discovery and RS256 signed id tokens.
+type oidcProvider struct {
+	cfg         oidcConfig
+	client      *http.Client
+	authURL     string
+	tokenURL    string
+	userinfoURL string
+	jwksURL     string
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey
+}
+
+func newOIDCProvider(ctx context.Context, cfg oidcConfig) (*oidcProvider, error) {
+	p := &oidcProvider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+		JwksURI               string `json:"jwks_uri"`
+	}
+	wellKnown := strings.TrimSuffix(cfg.issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, "", &discovery); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %v", err)
+	}
+	if discovery.Issuer != cfg.issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", discovery.Issuer, cfg.issuer)
+	}
+	p.authURL = discovery.AuthorizationEndpoint
+	p.tokenURL = discovery.TokenEndpoint
+	p.userinfoURL = discovery.UserinfoEndpoint
+	p.jwksURL = discovery.JwksURI
+	return p, nil
+}
+
+// oidcState is kept in a sealed cookie between the start of the login and the
+// callback, so the callback can't be replayed from another browser.
+type oidcState struct {
+	Type      string `json:"typ"`
+	State     string `json:"state"`
+	Nonce     string `json:"nonce"`
+	Verifier  string `json:"verifier"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// idTokenClaims are the claims of the id token and of the userinfo response
+// that are used for the login.
+type idTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	GivenName     string   `json:"given_name"`
+	FamilyName    string   `json:"family_name"`
+}
+
+// audience is either a single string or a list of strings in the id token.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcLoginHandler starts the login by redirecting to the identity provider.
+func (s *ApiServer) oidcLoginHandler(p *oidcProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := oidcState{
+			Type:      tokenTypeOIDCState,
+			State:     genRandomBytesHex(16),
+			Nonce:     genRandomBytesHex(16),
+			Verifier:  genRandomBytesHex(32),
+			ExpiresAt: time.Now().Add(oidcStateTTL).Unix(),
+		}
+		sealed, err := s.tokens.seal(state)
+		if err != nil {
+			writeHTTPError(w, status.Newf(codes.Internal, "failed to start login: %v", err))
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    sealed,
+			Path:     "/v1/oidc",
+			MaxAge:   int(oidcStateTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(s.cfg.publicURL, "https://"),
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		challenge := sha256.Sum256([]byte(state.Verifier))
+		q := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {p.cfg.clientID},
+			"redirect_uri":          {p.cfg.redirectURL},
+			"scope":                 {strings.Join(p.cfg.scopes, " ")},
+			"state":                 {state.State},
+			"nonce":                 {state.Nonce},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+			"code_challenge_method": {"S256"},
+		}
+		sep := "?"
+		if strings.Contains(p.authURL, "?") {
+			sep = "&"
+		}
+		http.Redirect(w, r, p.authURL+sep+q.Encode(), http.StatusFound)
+	}
+}
+
+// oidcCallbackHandler finishes the login and responds like the Login endpoint.
+func (s *ApiServer) oidcCallbackHandler(p *oidcProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			writeHTTPError(w, status.Newf(codes.Unauthenticated, "identity provider error: %s %s", e, q.Get("error_description")))
+			return
+		}
+
+		cookie, err := r.Cookie(oidcStateCookie)
+		if err != nil {
+			writeHTTPError(w, status.New(codes.Unauthenticated, "login expired, please try again"))
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/v1/oidc", MaxAge: -1})
+
+		var state oidcState
+		if err := s.tokens.unseal(cookie.Value, &state); err != nil || state.Type != tokenTypeOIDCState {
+			writeHTTPError(w, status.New(codes.Unauthenticated, "invalid login state"))
+			return
+		}
+		if time.Now().Unix() >= state.ExpiresAt {
+			writeHTTPError(w, status.New(codes.Unauthenticated, "login expired, please try again"))
+			return
+		}
+		if q.Get("state") != state.State || q.Get("code") == "" {
+			writeHTTPError(w, status.New(codes.Unauthenticated, "invalid login state"))
+			return
+		}
+
+		claims, err := p.exchange(r.Context(), q.Get("code"), state)
+		if err != nil {
+			writeHTTPError(w, status.Newf(codes.Unauthenticated, "failed to log in with the identity provider: %v", err))
+			return
+		}
+
+		res, err := s.oidcLogin(withRequestMetadata(r), claims)
+		if err != nil {
+			writeHTTPError(w, status.Convert(err))
+			return
+		}
+
+		body, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(res)
+		if err != nil {
+			writeHTTPError(w, status.Newf(codes.Internal, "failed to log in: %v", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// oidcLogin logs in the user behind the identity. Identities are linked to
+// existing users by their email, as long as the provider verified it.
+func (s *ApiServer) oidcLogin(ctx context.Context, claims *idTokenClaims) (*api.LoginResponse, error) {
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	row := tx.QueryRow(ctx, `
+		SELECT `+userColumns+`
+		FROM users
+		WHERE id = (SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2)
+	`, claims.Issuer, claims.Subject)
+	u, err := scanUser(row)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+	if err == nil && u.deletedAt.Valid {
+		s.db.recordAudit(ctx, auditEvent{actorID: u.id, subject: u.email, action: auditLogin, outcome: auditDenied, detail: "account deleted"})
+		return nil, errAccountDeleted(u.id, s.purgeAt(u.deletedAt.Time))
+	}
+
+	if err == pgx.ErrNoRows {
+		if claims.Email == "" || !claims.EmailVerified {
+			return nil, status.Errorf(codes.PermissionDenied, "the identity provider did not return a verified email")
+		}
+
+		row = tx.QueryRow(ctx, `
+			SELECT `+userColumns+`
+			FROM users
+			WHERE email = $1
+			FOR UPDATE
+		`, claims.Email)
+		u, err = scanUser(row)
+		switch err {
+		case nil:
+			if u.deletedAt.Valid {
+				s.db.recordAudit(ctx, auditEvent{actorID: u.id, subject: u.email, action: auditLogin, outcome: auditDenied, detail: "account deleted"})
+				return nil, errAccountDeleted(u.id, s.purgeAt(u.deletedAt.Time))
+			}
+			// Somebody could have registered the address with a password
+			// before its owner showed up. Proving the address through the
+			// provider wins over an unverified local account.
+			if !u.emailVerified {
+				if _, err = tx.Exec(ctx, `
+					UPDATE users
+					SET email_verified = true, password = NULL, email_verify_token = NULL, email_verify_token_expires = NULL
+					WHERE id = $1
+				`, u.id); err != nil {
+					return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+				}
+				if err = revokeUserSessions(ctx, tx, u.id); err != nil {
+					return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+				}
+				u.emailVerified = true
+			}
+		case pgx.ErrNoRows:
+			// new accounts need an invite code, which only CreateAccount takes
+			if s.cfg.registrationMode == registrationInvite {
+				s.db.recordAudit(ctx, auditEvent{subject: claims.Email, action: auditCreateAccount, outcome: auditDenied, detail: "oidc without invite"})
+				return nil, status.Errorf(codes.PermissionDenied, "registration is invite only, register with an invite code first")
+			}
+			row = tx.QueryRow(ctx, `
+				INSERT INTO users (email, first_name, last_name, email_verified, auth_method, activated_at)
+				VALUES ($1, $2, $3, true, $4, CASE WHEN $5 THEN NULL ELSE now() END)
+				RETURNING `+userColumns,
+				claims.Email,
+				claims.GivenName,
+				claims.FamilyName,
+				authMethodOIDC,
+				s.cfg.approvalRequired,
+			)
+			u, err = scanUser(row)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+			}
+		default:
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+
+		if _, err = tx.Exec(ctx, `
+			INSERT INTO user_identities (user_id, issuer, subject)
+			VALUES ($1, $2, $3)
+		`, u.id, claims.Issuer, claims.Subject); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+	}
+
+	// the provider stands in for the password, an account locked for failed
+	// logins stays locked here too
+	if err = s.checkLockout(ctx, accountThrottleKey(u.id)); err != nil {
+		s.db.recordAudit(ctx, auditEvent{actorID: u.id, subject: u.email, action: auditLogin, outcome: auditDenied, detail: "locked out"})
+		return nil, err
+	}
+
+	if u.authMethod.String != authMethodOIDC {
+		if _, err = tx.Exec(ctx, `
+			UPDATE users
+			SET auth_method = $2
+			WHERE id = $1
+		`, u.id, authMethodOIDC); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		u.authMethod.String, u.authMethod.Valid = authMethodOIDC, true
+	}
+
+	// the account and the identity are kept, the user can log in once an
+	// admin activated it
+	if s.cfg.approvalRequired && !u.activatedAt.Valid {
+		if err = tx.Commit(ctx); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		s.db.recordAudit(ctx, auditEvent{actorID: u.id, subject: u.email, action: auditLogin, outcome: auditDenied, detail: "waiting for approval"})
+		return nil, errAccountInactive(u.id)
+	}
+
+	// the provider only stands in for the password, the second factor is
+	// still asked for
+	enabled, err := totpEnabled(ctx, tx, u.id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+	if enabled {
+		challenge, err := s.newLoginChallenge(u.id)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		if err = tx.Commit(ctx); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		return &api.LoginResponse{Message: "enter the code of your authenticator app to finish logging in", TotpRequired: true, ChallengeToken: challenge}, nil
+	}
+
+	if err = loginSucceeded(ctx, tx, u.id); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+
+	tokens, err := s.newSession(ctx, tx, u.id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{actorID: u.id, subject: u.email, action: auditLogin, outcome: auditSuccess, detail: "oidc"})
+
+	return &api.LoginResponse{User: u.toProto(), Message: fmt.Sprintf("user %s successfully logged in", u.email), Tokens: tokens}, nil
+}
+
+// exchange trades the authorization code for the tokens and returns the
+// verified claims of the id token.
+func (p *oidcProvider) exchange(ctx context.Context, code string, state oidcState) (*idTokenClaims, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.redirectURL},
+		"code_verifier": {state.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.clientID), url.QueryEscape(p.cfg.clientSecret))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s", res.Status)
+	}
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+
+	claims, err := p.verifyIDToken(ctx, tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != state.Nonce {
+		return nil, fmt.Errorf("id token nonce mismatch")
+	}
+
+	// not every provider puts the email into the id token
+	if claims.Email == "" && p.userinfoURL != "" && tokens.AccessToken != "" {
+		var info idTokenClaims
+		if err := p.getJSON(ctx, p.userinfoURL, tokens.AccessToken, &info); err != nil {
+			return nil, fmt.Errorf("userinfo: %v", err)
+		}
+		if info.Subject != claims.Subject {
+			return nil, fmt.Errorf("userinfo subject mismatch")
+		}
+		claims.Email = info.Email
+		claims.EmailVerified = info.EmailVerified
+		claims.GivenName = info.GivenName
+		claims.FamilyName = info.FamilyName
+	}
+	return claims, nil
+}
+
+func (p *oidcProvider) verifyIDToken(ctx context.Context, token string) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed id token header")
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported id token algorithm %q", header.Alg)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed id token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("invalid id token signature")
+	}
+
+	var claims idTokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed id token claims")
+	}
+	if claims.Issuer != p.cfg.issuer {
+		return nil, fmt.Errorf("id token issued by %q", claims.Issuer)
+	}
+	if !claims.Audience.contains(p.cfg.clientID) {
+		return nil, fmt.Errorf("id token not issued for this client")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("id token expired")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("id token has no subject")
+	}
+	return &claims, nil
+}
+
+// key returns the signing key with the given id, the key set is fetched again
+// when the provider rotated its keys.
+func (p *oidcProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.jwksURL, "", &jwks); err != nil {
+		return nil, fmt.Errorf("jwks: %v", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.keys = keys
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown id token key %q", kid)
+	}
+	return key, nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, url, bearer string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
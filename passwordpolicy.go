@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// passwordPolicy decides which passwords can be set, it is checked everywhere
+// a password is chosen.
+type passwordPolicy struct {
+	minLength  int
+	minEntropy float64
+	// nil when no breached password list is configured
+	breached *bloomFilter
+}
+
+func newPasswordPolicy(minLength int, minEntropy float64, breached *bloomFilter) *passwordPolicy {
+	return &passwordPolicy{
+		minLength,
+		minEntropy,
+		breached,
+	}
+}
+
+// check returns an InvalidArgument error with a BadRequest detail listing the
+// violations for the field. personal holds the email and names of the user,
+// which the password must not contain.
+func (p *passwordPolicy) check(field, password string, personal ...string) error {
+	var violations []*errdetails.BadRequest_FieldViolation
+	violate := func(description string) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: field, Description: description})
+	}
+
+	if utf8.RuneCountInString(password) < p.minLength {
+		violate(fmt.Sprintf("must be at least %d characters long", p.minLength))
+	}
+	if estimateEntropy(password) < p.minEntropy {
+		violate("is too easy to guess, use a longer password or more kinds of characters")
+	}
+	lower := strings.ToLower(password)
+	for _, value := range personalTerms(personal) {
+		if strings.Contains(lower, value) {
+			violate("must not contain your email or name")
+			break
+		}
+	}
+	if p.breached != nil && p.breached.containsPassword(password) {
+		violate("appeared in a data breach, choose another password")
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	st := status.New(codes.InvalidArgument, "password does not meet the requirements")
+	if detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// personalTerms splits the email into its parts, terms shorter than three
+// characters are too common to be checked.
+func personalTerms(personal []string) []string {
+	var terms []string
+	for _, value := range personal {
+		value = strings.ToLower(strings.TrimSpace(value))
+		candidates := []string{value}
+		if at := strings.LastIndexByte(value, '@'); at > 0 {
+			candidates = append(candidates, value[:at])
+		}
+		for _, term := range candidates {
+			if len(term) >= 3 {
+				terms = append(terms, term)
+			}
+		}
+	}
+	return terms
+}
+
+// estimateEntropy is a rough estimate of the bits needed to guess the
+// password, in the spirit of zxcvbn. Every character adds the bits of the
+// character classes used, but repeated characters and runs like "abc" or
+// "321" add almost nothing, and characters seen before add half.
+func estimateEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	bits := math.Log2(float64(pool))
+	seen := map[rune]bool{}
+	var entropy float64
+	prev, delta := rune(-1), rune(0)
+	for _, r := range strings.ToLower(password) {
+		d := r - prev
+		switch {
+		case r == prev:
+			entropy += 1
+		case prev >= 0 && (d == 1 || d == -1) && (delta == 0 || d == delta):
+			entropy += 1
+		case seen[r]:
+			entropy += bits / 2
+		default:
+			entropy += bits
+		}
+		if prev >= 0 && (d == 1 || d == -1) {
+			delta = d
+		} else {
+			delta = 0
+		}
+		seen[r] = true
+		prev = r
+	}
+	return entropy
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha1"
+	"math"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestEstimateEntropy(t *testing.T) {
+	lower := math.Log2(26)
+	tests := []struct {
+		password string
+		want     float64
+	}{
+		{"", 0},
+		{"a", lower},
+		{"aaaaaaaa", lower + 7},
+		{"abcdefgh", lower + 7},
+		{"hgfedcba", lower + 7},
+		// the run breaks when the direction changes, then the characters
+		// were seen before
+		{"abab", lower + 1 + lower},
+		{"password", 7*lower + 1},
+		{"aB3$", 3*math.Log2(95) + 1},
+		{"é", math.Log2(100)},
+	}
+	for _, tt := range tests {
+		if got := estimateEntropy(tt.password); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("estimateEntropy(%q) = %f, want %f", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	breached := newBloomFilter(10, 0.001)
+	breached.add(sha1.Sum([]byte("Breached passw0rd!")))
+	policy := newPasswordPolicy(10, 50, breached)
+
+	tests := []struct {
+		name       string
+		password   string
+		violations []string
+	}{
+		{"strong", "correct horse battery staple", nil},
+		{"too short", "x9$Lq", []string{"must be at least 10 characters long", "is too easy to guess, use a longer password or more kinds of characters"}},
+		{"too easy", "aaaaaaaaaaaa", []string{"is too easy to guess, use a longer password or more kinds of characters"}},
+		{"email", "my address is jane@example.com", []string{"must not contain your email or name"}},
+		{"email local part", "Mkq2-JANE.DOE-zt91", []string{"must not contain your email or name"}},
+		{"breached", "Breached passw0rd!", []string{"appeared in a data breach, choose another password"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.check("password", tt.password, "jane.doe@example.com", "Jane", "Doe")
+			if tt.violations == nil {
+				if err != nil {
+					t.Fatalf("check() error = %v, want nil", err)
+				}
+				return
+			}
+			st, _ := status.FromError(err)
+			if st.Code() != codes.InvalidArgument {
+				t.Fatalf("check() code = %s, want %s", st.Code(), codes.InvalidArgument)
+			}
+			var got []string
+			for _, detail := range st.Details() {
+				if br, ok := detail.(*errdetails.BadRequest); ok {
+					for _, v := range br.FieldViolations {
+						if v.Field != "password" {
+							t.Errorf("violation field = %q, want password", v.Field)
+						}
+						got = append(got, v.Description)
+					}
+				}
+			}
+			if len(got) != len(tt.violations) {
+				t.Fatalf("check() violations = %q, want %q", got, tt.violations)
+			}
+			for i := range got {
+				if got[i] != tt.violations[i] {
+					t.Errorf("check() violations = %q, want %q", got, tt.violations)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordAlgorithmBcrypt   = "bcrypt"
+	passwordAlgorithmArgon2id = "argon2id"
+)
+
+var errUnknownPasswordHash = errors.New("unknown password hash format")
+
+// argon2Params are the argon2id parameters, memory is in KiB.
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	saltLen uint32
+	keyLen  uint32
+}
+
+// passwordHasher hashes new passwords with the configured algorithm. The
+// hashes describe themselves, bcrypt in the modular crypt format and argon2id
+// in the PHC string format, so hashes made with an older policy can still be
+// verified and are upgraded on the next login.
+type passwordHasher struct {
+	algorithm  string
+	bcryptCost int
+	argon2     argon2Params
+	// every argon2id hash takes argon2.memory KiB, at most cap(slots) are
+	// computed at once so a burst of logins can't run the server out of
+	// memory
+	slots chan struct{}
+}
+
+func newPasswordHasher(algorithm string, bcryptCost int, argon2 argon2Params, concurrency int) (*passwordHasher, error) {
+	if concurrency < 1 {
+		return nil, errors.New("password hashing concurrency must be at least 1")
+	}
+	switch algorithm {
+	case passwordAlgorithmBcrypt:
+		if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case passwordAlgorithmArgon2id:
+		if argon2.memory < 8*uint32(argon2.threads) || argon2.time < 1 || argon2.threads < 1 {
+			return nil, errors.New("invalid argon2id parameters")
+		}
+	default:
+		return nil, fmt.Errorf("unknown password hashing algorithm %q", algorithm)
+	}
+	return &passwordHasher{
+		algorithm,
+		bcryptCost,
+		argon2,
+		make(chan struct{}, concurrency),
+	}, nil
+}
+
+func (h *passwordHasher) hash(password string) (string, error) {
+	h.slots <- struct{}{}
+	defer func() { <-h.slots }()
+
+	if h.algorithm == passwordAlgorithmBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+
+	salt := make([]byte, h.argon2.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.argon2.time, h.argon2.memory, h.argon2.threads, h.argon2.keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.argon2.memory,
+		h.argon2.time,
+		h.argon2.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// verify reports whether the password matches the hash, and whether the hash
+// was made with another policy than the current one and should be replaced.
+func (h *passwordHasher) verify(hash, password string) (ok bool, rehash bool, err error) {
+	h.slots <- struct{}{}
+	defer func() { <-h.slots }()
+
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false, false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return false, false, nil
+		}
+		current := h.algorithm == passwordAlgorithmArgon2id &&
+			params.memory == h.argon2.memory &&
+			params.time == h.argon2.time &&
+			params.threads == h.argon2.threads &&
+			uint32(len(key)) == h.argon2.keyLen
+		return true, !current, nil
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, false, errUnknownPasswordHash
+	}
+	if err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+	return true, h.algorithm != passwordAlgorithmBcrypt || cost != h.bcryptCost, nil
+}
+
+// parseArgon2Hash parses "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>".
+func parseArgon2Hash(hash string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+// small parameters to keep the tests fast
+var testArgon2 = argon2Params{memory: 64, time: 1, threads: 1, saltLen: 16, keyLen: 32}
+
+func mustPasswordHasher(t *testing.T, algorithm string, bcryptCost int, argon2 argon2Params) *passwordHasher {
+	t.Helper()
+	h, err := newPasswordHasher(algorithm, bcryptCost, argon2, 1)
+	if err != nil {
+		t.Fatalf("newPasswordHasher: %v", err)
+	}
+	return h
+}
+
+func mustHash(t *testing.T, h *passwordHasher, password string) string {
+	t.Helper()
+	hash, err := h.hash(password)
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	return hash
+}
+
+func TestPasswordHasherVerify(t *testing.T) {
+	argon := mustPasswordHasher(t, passwordAlgorithmArgon2id, 4, testArgon2)
+	moreMemory := testArgon2
+	moreMemory.memory = 128
+	argonMoreMemory := mustPasswordHasher(t, passwordAlgorithmArgon2id, 4, moreMemory)
+	bcryptCost4 := mustPasswordHasher(t, passwordAlgorithmBcrypt, 4, testArgon2)
+	bcryptCost5 := mustPasswordHasher(t, passwordAlgorithmBcrypt, 5, testArgon2)
+
+	argonHash := mustHash(t, argon, "correct horse")
+	bcryptHash := mustHash(t, bcryptCost4, "correct horse")
+
+	tests := []struct {
+		name     string
+		hasher   *passwordHasher
+		hash     string
+		password string
+		ok       bool
+		rehash   bool
+		err      error
+	}{
+		{"argon2id current", argon, argonHash, "correct horse", true, false, nil},
+		{"argon2id wrong password", argon, argonHash, "battery staple", false, false, nil},
+		{"argon2id other memory", argonMoreMemory, argonHash, "correct horse", true, true, nil},
+		{"argon2id to bcrypt", bcryptCost4, argonHash, "correct horse", true, true, nil},
+		{"bcrypt current", bcryptCost4, bcryptHash, "correct horse", true, false, nil},
+		{"bcrypt wrong password", bcryptCost4, bcryptHash, "battery staple", false, false, nil},
+		{"bcrypt other cost", bcryptCost5, bcryptHash, "correct horse", true, true, nil},
+		{"bcrypt to argon2id", argon, bcryptHash, "correct horse", true, true, nil},
+		{"unknown format", argon, "plaintext", "plaintext", false, false, errUnknownPasswordHash},
+		{"malformed argon2id", argon, "$argon2id$v=19$m=64,t=1,p=1$salt", "correct horse", false, false, errUnknownPasswordHash},
+		{"other argon2 version", argon, "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5", "correct horse", false, false, errUnknownPasswordHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash, err := tt.hasher.verify(tt.hash, tt.password)
+			if err != tt.err {
+				t.Fatalf("verify() error = %v, want %v", err, tt.err)
+			}
+			if ok != tt.ok || rehash != tt.rehash {
+				t.Errorf("verify() = %v, %v, want %v, %v", ok, rehash, tt.ok, tt.rehash)
+			}
+		})
+	}
+}
+
+func TestNewPasswordHasher(t *testing.T) {
+	tests := []struct {
+		name        string
+		algorithm   string
+		bcryptCost  int
+		argon2      argon2Params
+		concurrency int
+		ok          bool
+	}{
+		{"argon2id", passwordAlgorithmArgon2id, 12, testArgon2, 1, true},
+		{"bcrypt", passwordAlgorithmBcrypt, 12, testArgon2, 1, true},
+		{"unknown algorithm", "md5", 12, testArgon2, 1, false},
+		{"bcrypt cost too low", passwordAlgorithmBcrypt, 3, testArgon2, 1, false},
+		{"bcrypt cost too high", passwordAlgorithmBcrypt, 32, testArgon2, 1, false},
+		{"argon2id no time", passwordAlgorithmArgon2id, 12, argon2Params{memory: 64, threads: 1}, 1, false},
+		{"argon2id too little memory", passwordAlgorithmArgon2id, 12, argon2Params{memory: 8, time: 1, threads: 2}, 1, false},
+		{"no concurrency", passwordAlgorithmArgon2id, 12, testArgon2, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newPasswordHasher(tt.algorithm, tt.bcryptCost, tt.argon2, tt.concurrency)
+			if (err == nil) != tt.ok {
+				t.Errorf("newPasswordHasher() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
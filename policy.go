@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// The roles as they are stored in users.user_type.
+const (
+	userTypeUser  = "user"
+	userTypeAdmin = "admin"
+)
+
+func roleFromUserType(userType string) api.Role {
+	switch userType {
+	case userTypeUser:
+		return api.Role_ROLE_USER
+	case userTypeAdmin:
+		return api.Role_ROLE_ADMIN
+	default:
+		return api.Role_ROLE_UNSPECIFIED
+	}
+}
+
+// methodPolicies holds the (tracker.v1.policy) option of every rpc, keyed by
+// the full method name.
+var methodPolicies = loadPolicies()
+
+func loadPolicies() map[string]*api.Policy {
+	policies := map[string]*api.Policy{}
+	services := api.File_service_proto.Services()
+	for i := 0; i < services.Len(); i++ {
+		service := services.Get(i)
+		methods := service.Methods()
+		for j := 0; j < methods.Len(); j++ {
+			method := methods.Get(j)
+			opts, ok := method.Options().(*descriptorpb.MethodOptions)
+			if !ok || !proto.HasExtension(opts, api.E_Policy) {
+				continue
+			}
+			name := fmt.Sprintf("/%s/%s", service.FullName(), method.Name())
+			policies[name] = proto.GetExtension(opts, api.E_Policy).(*api.Policy)
+		}
+	}
+	return policies
+}
+
+// isPublic reports whether the method can be called without being logged in.
+func isPublic(method string) bool {
+	return methodPolicies[method].GetPublic()
+}
+
+// authorize checks the policy of the method against the caller in the context.
+func authorize(ctx context.Context, db *Database, method string) error {
+	policy, ok := methodPolicies[method]
+	if !ok {
+		return status.Errorf(codes.PermissionDenied, "%s has no policy", method)
+	}
+	if policy.Public {
+		return nil
+	}
+	if _, ok := ctx.Value(service).(*servicePrincipal); ok && !policy.AllowService {
+		return status.Errorf(codes.PermissionDenied, "%s acts as a user, services have to call it with a user token", method)
+	}
+
+	if key, ok := ctx.Value(apiKey).(*apiKeyPrincipal); ok && !key.allows(policy.ApiKeyScope) {
+		return status.Errorf(codes.PermissionDenied, "api key is not allowed to call %s", method)
+	}
+	if _, ok := ctx.Value(impersonator).(string); ok && policy.DenyImpersonation {
+		return status.Errorf(codes.PermissionDenied, "%s can't be called while impersonating a user", method)
+	}
+
+	// every logged in user has the user role, the database is only asked for
+	// the rpcs that need more
+	if policy.Role <= api.Role_ROLE_USER {
+		return nil
+	}
+	role, err := callerRole(ctx, db)
+	if err != nil {
+		return err
+	}
+	if role < policy.Role {
+		return status.Errorf(codes.PermissionDenied, "%s requires the %s role", method, policy.Role)
+	}
+	return nil
+}
+
+// callerRole returns the role of the user or service in the context.
+func callerRole(ctx context.Context, db *Database) (api.Role, error) {
+	if svc, ok := ctx.Value(service).(*servicePrincipal); ok {
+		return svc.role, nil
+	}
+	var userType string
+	err := db.conn.QueryRow(ctx, `
+		SELECT user_type
+		FROM users
+		WHERE id = $1
+		AND deleted_at IS NULL
+	`, ctx.Value(user)).Scan(&userType)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return api.Role_ROLE_UNSPECIFIED, status.Errorf(codes.Unauthenticated, "user not found")
+		}
+		return api.Role_ROLE_UNSPECIFIED, status.Errorf(codes.Internal, "failed to authorize: %v", err)
+	}
+	return roleFromUserType(userType), nil
+}
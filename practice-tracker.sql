@@ -32,7 +32,7 @@ COMMENT ON EXTENSION pgcrypto IS 'cryptographic functions';
 CREATE TABLE public.users (
     id public.citext DEFAULT ('us-'::text || encode(public.gen_random_bytes(6), 'hex'::text)) UNIQUE NOT NULL,
     email public.citext NOT NULL,
-    user_type text NOT NULL DEFAULT 'admin',
+    user_type text NOT NULL DEFAULT 'user' CHECK (user_type IN ('user', 'admin')),
     activated_at timestamp without time zone,
     email_verified boolean DEFAULT false,
     password text,
@@ -41,11 +41,224 @@ CREATE TABLE public.users (
     auth_method text,
     reset_password_token text,
     email_verify_token text,
+    email_verify_token_expires timestamp without time zone,
     reset_password_token_expires timestamp without time zone,
     created_at timestamp without time zone DEFAULT now() NOT NULL,
     deleted_at timestamp without time zone
 );
 
+--
+-- Name: sessions; Type: TABLE; Schema: public; Owner: hasmik
+--
+-- A session starts at login, its id is the family_id of its refresh tokens.
+-- ip and last_seen_at are updated at most once a minute.
+--
+
+CREATE TABLE public.sessions (
+    id public.citext DEFAULT ('sess-'::text || encode(public.gen_random_bytes(6), 'hex'::text)) NOT NULL,
+    user_id public.citext NOT NULL,
+    user_agent text DEFAULT ''::text NOT NULL,
+    ip text DEFAULT ''::text NOT NULL,
+    created_at timestamp without time zone DEFAULT now() NOT NULL,
+    last_seen_at timestamp without time zone DEFAULT now() NOT NULL,
+    revoked_at timestamp without time zone
+);
+
+--
+-- Name: refresh_tokens; Type: TABLE; Schema: public; Owner: hasmik
+--
+-- Every refresh token belongs to a family that starts at login. Rotating a
+-- token marks it rotated_at and issues the next one in the same family.
+--
+
+CREATE TABLE public.refresh_tokens (
+    id public.citext DEFAULT ('rt-'::text || encode(public.gen_random_bytes(6), 'hex'::text)) UNIQUE NOT NULL,
+    user_id public.citext NOT NULL,
+    family_id public.citext NOT NULL,
+    token_hash text NOT NULL,
+    created_at timestamp without time zone DEFAULT now() NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    rotated_at timestamp without time zone,
+    revoked_at timestamp without time zone
+);
+
+--
+-- Name: api_keys; Type: TABLE; Schema: public; Owner: hasmik
+--
+-- Only the sha256 of a key is stored, prefix is the visible start of the key
+-- that is used to look it up.
+--
+
+CREATE TABLE public.api_keys (
+    id public.citext DEFAULT ('key-'::text || encode(public.gen_random_bytes(6), 'hex'::text)) UNIQUE NOT NULL,
+    user_id public.citext NOT NULL,
+    key_name text NOT NULL,
+    prefix text NOT NULL,
+    key_hash text NOT NULL,
+    scopes text[] DEFAULT '{}'::text[] NOT NULL,
+    created_at timestamp without time zone DEFAULT now() NOT NULL,
+    last_used_at timestamp without time zone,
+    revoked_at timestamp without time zone
+);
+
+--
+-- Name: user_identities; Type: TABLE; Schema: public; Owner: hasmik
+--
+-- Links the accounts of external OpenID Connect providers to users.
+--
+
+CREATE TABLE public.user_identities (
+    user_id public.citext NOT NULL,
+    issuer text NOT NULL,
+    subject text NOT NULL,
+    created_at timestamp without time zone DEFAULT now() NOT NULL
+);
+
+--
+-- Name: user_totp; Type: TABLE; Schema: public; Owner: hasmik
+--
+-- secret is encrypted with AES-GCM using TOTP_ENCRYPTION_KEY, enabled_at
+-- stays NULL until the first code was confirmed. last_used_step stops a code
+-- from being used twice.
+--
+
+CREATE TABLE public.user_totp (
+    user_id public.citext NOT NULL,
+    secret bytea NOT NULL,
+    enabled_at timestamp without time zone,
+    last_used_step bigint DEFAULT 0 NOT NULL,
+    created_at timestamp without time zone DEFAULT now() NOT NULL
+);
+
+CREATE TABLE public.totp_recovery_codes (
+    user_id public.citext NOT NULL,
+    code_hash text NOT NULL,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone DEFAULT now() NOT NULL
+);
+
+--
+-- Name: login_throttle; Type: TABLE; Schema: public; Owner: hasmik
+--
+-- Failed logins per key, "user:<id>" for an account and "ip:<address>" for a
+-- client. locked_until is set once a key has too many failures.
+--
+
+CREATE TABLE public.login_throttle (
+    key text NOT NULL,
+    failures integer DEFAULT 0 NOT NULL,
+    last_failure_at timestamp without time zone DEFAULT now() NOT NULL,
+    locked_until timestamp without time zone
+);
+
+--
+-- Name: audit_events; Type: TABLE; Schema: public; Owner: hasmik
+--
+-- Append only, the trigger below rejects updates and deletes. actor_id has no
+-- foreign key so the events outlive the accounts they are about. created_at
+-- is in UTC whatever the time zone of the session.
+--
+
+CREATE TABLE public.audit_events (
+    id bigserial NOT NULL,
+    actor_id public.citext,
+    subject text DEFAULT ''::text NOT NULL,
+    action text NOT NULL,
+    outcome text NOT NULL,
+    detail text DEFAULT ''::text NOT NULL,
+    ip text DEFAULT ''::text NOT NULL,
+    user_agent text DEFAULT ''::text NOT NULL,
+    created_at timestamp without time zone DEFAULT (now() AT TIME ZONE 'UTC'::text) NOT NULL
+);
+
+CREATE FUNCTION public.audit_events_append_only() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append only';
+END;
+$$;
+
+--
+-- Name: email_changes; Type: TABLE; Schema: public; Owner: hasmik
+--
+-- A pending change of users.email to new_email, confirmed with the token
+-- sent to the new address. Once confirmed the old address can revert it with
+-- revert_token until revert_expires_at.
+--
+
+CREATE TABLE public.email_changes (
+    id public.citext DEFAULT ('ec-'::text || encode(public.gen_random_bytes(6), 'hex'::text)) NOT NULL,
+    user_id public.citext NOT NULL,
+    old_email public.citext NOT NULL,
+    new_email public.citext NOT NULL,
+    token_hash text NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    confirmed_at timestamp without time zone,
+    revert_token_hash text,
+    revert_expires_at timestamp without time zone,
+    reverted_at timestamp without time zone,
+    created_at timestamp without time zone DEFAULT now() NOT NULL
+);
+
+--
+-- Name: export_jobs; Type: TABLE; Schema: public; Owner: hasmik
+--
+-- status is pending, running, ready or failed. The archive is kept until
+-- expires_at, started_at lets a worker take over jobs of a crashed one.
+--
+
+CREATE TABLE public.export_jobs (
+    id public.citext DEFAULT ('exp-'::text || encode(public.gen_random_bytes(6), 'hex'::text)) NOT NULL,
+    user_id public.citext NOT NULL,
+    status text DEFAULT 'pending'::text NOT NULL CHECK (status IN ('pending', 'running', 'ready', 'failed')),
+    error text DEFAULT ''::text NOT NULL,
+    archive bytea,
+    created_at timestamp without time zone DEFAULT now() NOT NULL,
+    started_at timestamp without time zone,
+    completed_at timestamp without time zone,
+    expires_at timestamp without time zone
+);
+
+
+--
+-- Name: invites; Type: TABLE; Schema: public; Owner: hasmik
+--
+-- Invite codes for REGISTRATION_MODE=invite. Every registration with the code
+-- takes one of max_uses, the account gets user_type and joins group_id when
+-- they are set.
+--
+
+CREATE TABLE public.invites (
+    id public.citext DEFAULT ('inv-'::text || encode(public.gen_random_bytes(6), 'hex'::text)) NOT NULL,
+    code_hash text NOT NULL,
+    created_by public.citext,
+    max_uses integer DEFAULT 1 NOT NULL CHECK (max_uses > 0),
+    uses integer DEFAULT 0 NOT NULL CHECK (uses >= 0 AND uses <= max_uses),
+    user_type text,
+    group_id public.citext,
+    expires_at timestamp without time zone NOT NULL,
+    created_at timestamp without time zone DEFAULT now() NOT NULL
+);
+
+
+--
+-- Name: magic_links; Type: TABLE; Schema: public; Owner: hasmik
+--
+-- One-time sign-in links. The link carries the token, nonce_hash is the hash
+-- of the cookie set in the browser that asked for it.
+--
+
+CREATE TABLE public.magic_links (
+    id public.citext DEFAULT ('ml-'::text || encode(public.gen_random_bytes(6), 'hex'::text)) NOT NULL,
+    user_id public.citext NOT NULL,
+    token_hash text NOT NULL,
+    nonce_hash text NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone DEFAULT now() NOT NULL
+);
+
 
 CREATE TABLE public.groups (
     id public.citext DEFAULT ('ug-'::text || encode(public.gen_random_bytes(6), 'hex'::text)) UNIQUE NOT NULL,
@@ -161,6 +374,130 @@ ALTER TABLE ONLY public.users
 
 ALTER TABLE ONLY public.users ADD CONSTRAINT users_email_key UNIQUE (email);
 --
+-- public.refresh_tokens table
+--
+ALTER TABLE ONLY public.refresh_tokens
+    ADD CONSTRAINT refresh_tokens_pkey PRIMARY KEY (id);
+
+ALTER TABLE ONLY public.refresh_tokens ADD CONSTRAINT refresh_tokens_token_hash_key UNIQUE (token_hash);
+
+CREATE INDEX refresh_tokens_family_id_idx ON public.refresh_tokens USING btree ("family_id");
+
+ALTER TABLE ONLY public.refresh_tokens
+    ADD CONSTRAINT refresh_tokens_user_id_fkey FOREIGN KEY ("user_id") REFERENCES public.users(id);
+--
+-- public.sessions table
+--
+ALTER TABLE ONLY public.sessions
+    ADD CONSTRAINT sessions_pkey PRIMARY KEY (id);
+
+CREATE INDEX sessions_user_id_idx ON public.sessions USING btree ("user_id");
+
+ALTER TABLE ONLY public.sessions
+    ADD CONSTRAINT sessions_user_id_fkey FOREIGN KEY ("user_id") REFERENCES public.users(id);
+--
+-- public.api_keys table
+--
+ALTER TABLE ONLY public.api_keys
+    ADD CONSTRAINT api_keys_pkey PRIMARY KEY (id);
+
+ALTER TABLE ONLY public.api_keys ADD CONSTRAINT api_keys_prefix_key UNIQUE (prefix);
+
+ALTER TABLE ONLY public.api_keys
+    ADD CONSTRAINT api_keys_user_id_fkey FOREIGN KEY ("user_id") REFERENCES public.users(id);
+--
+-- public.user_identities table
+--
+ALTER TABLE ONLY public.user_identities
+    ADD CONSTRAINT user_identities_pkey PRIMARY KEY (issuer, subject);
+
+ALTER TABLE ONLY public.user_identities
+    ADD CONSTRAINT user_identities_user_id_fkey FOREIGN KEY ("user_id") REFERENCES public.users(id);
+--
+-- public.user_totp table
+--
+ALTER TABLE ONLY public.user_totp
+    ADD CONSTRAINT user_totp_pkey PRIMARY KEY (user_id);
+
+ALTER TABLE ONLY public.user_totp
+    ADD CONSTRAINT user_totp_user_id_fkey FOREIGN KEY ("user_id") REFERENCES public.users(id);
+--
+-- public.totp_recovery_codes table
+--
+ALTER TABLE ONLY public.totp_recovery_codes
+    ADD CONSTRAINT totp_recovery_codes_pkey PRIMARY KEY (user_id, code_hash);
+
+ALTER TABLE ONLY public.totp_recovery_codes
+    ADD CONSTRAINT totp_recovery_codes_user_id_fkey FOREIGN KEY ("user_id") REFERENCES public.users(id);
+--
+-- public.login_throttle table
+--
+ALTER TABLE ONLY public.login_throttle
+    ADD CONSTRAINT login_throttle_pkey PRIMARY KEY (key);
+--
+-- public.audit_events table
+--
+ALTER TABLE ONLY public.audit_events
+    ADD CONSTRAINT audit_events_pkey PRIMARY KEY (id);
+
+CREATE INDEX audit_events_actor_id_idx ON public.audit_events USING btree ("actor_id", "id");
+
+CREATE INDEX audit_events_created_at_idx ON public.audit_events USING btree ("created_at");
+
+CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON public.audit_events
+    FOR EACH STATEMENT EXECUTE FUNCTION public.audit_events_append_only();
+--
+-- public.email_changes table
+--
+ALTER TABLE ONLY public.email_changes
+    ADD CONSTRAINT email_changes_pkey PRIMARY KEY (id);
+
+ALTER TABLE ONLY public.email_changes ADD CONSTRAINT email_changes_token_hash_key UNIQUE (token_hash);
+
+ALTER TABLE ONLY public.email_changes ADD CONSTRAINT email_changes_revert_token_hash_key UNIQUE (revert_token_hash);
+
+CREATE INDEX email_changes_user_id_idx ON public.email_changes USING btree ("user_id");
+
+ALTER TABLE ONLY public.email_changes
+    ADD CONSTRAINT email_changes_user_id_fkey FOREIGN KEY ("user_id") REFERENCES public.users(id);
+--
+-- public.export_jobs table
+--
+ALTER TABLE ONLY public.export_jobs
+    ADD CONSTRAINT export_jobs_pkey PRIMARY KEY (id);
+
+CREATE INDEX export_jobs_user_id_idx ON public.export_jobs USING btree ("user_id");
+
+CREATE INDEX export_jobs_status_idx ON public.export_jobs USING btree ("status", "created_at");
+
+ALTER TABLE ONLY public.export_jobs
+    ADD CONSTRAINT export_jobs_user_id_fkey FOREIGN KEY ("user_id") REFERENCES public.users(id);
+--
+-- public.invites table
+--
+ALTER TABLE ONLY public.invites
+    ADD CONSTRAINT invites_pkey PRIMARY KEY (id);
+
+ALTER TABLE ONLY public.invites ADD CONSTRAINT invites_code_hash_key UNIQUE (code_hash);
+
+ALTER TABLE ONLY public.invites
+    ADD CONSTRAINT invites_created_by_fkey FOREIGN KEY ("created_by") REFERENCES public.users(id);
+
+ALTER TABLE ONLY public.invites
+    ADD CONSTRAINT invites_group_id_fkey FOREIGN KEY ("group_id") REFERENCES public.groups(id);
+--
+-- public.magic_links table
+--
+ALTER TABLE ONLY public.magic_links
+    ADD CONSTRAINT magic_links_pkey PRIMARY KEY (id);
+
+ALTER TABLE ONLY public.magic_links ADD CONSTRAINT magic_links_token_hash_key UNIQUE (token_hash);
+
+CREATE INDEX magic_links_user_id_idx ON public.magic_links USING btree ("user_id");
+
+ALTER TABLE ONLY public.magic_links
+    ADD CONSTRAINT magic_links_user_id_fkey FOREIGN KEY ("user_id") REFERENCES public.users(id);
+--
 -- public.groups table
 --
 ALTER TABLE ONLY public.groups
@@ -173,6 +510,20 @@ CREATE UNIQUE INDEX group_name_constraint ON public.groups USING btree ("user_id
 ALTER TABLE ONLY public.tickets
     ADD CONSTRAINT tickets_pkey PRIMARY KEY (id);
 --
+-- the ticket catalogs, names are unique regardless of case
+--
+CREATE UNIQUE INDEX languages_lang_name_key ON public.languages USING btree (lower(lang_name));
+
+CREATE UNIQUE INDEX technologies_tech_name_key ON public.technologies USING btree (lower(tech_name));
+
+CREATE UNIQUE INDEX yt_channels_ytch_name_key ON public.yt_channels USING btree (lower(ytch_name));
+
+CREATE UNIQUE INDEX resources_rscs_name_key ON public.resources USING btree (lower(rscs_name));
+
+CREATE UNIQUE INDEX sources_src_name_key ON public.sources USING btree (lower(src_name));
+
+CREATE UNIQUE INDEX docs_docs_name_key ON public.docs USING btree (lower(docs_name));
+--
 -- public.groups_users table
 --
 CREATE UNIQUE INDEX group_users_constraint ON public.group_users USING btree ("user_id", "group_id") WHERE ("deleted_at" IS NULL);
@@ -221,7 +572,7 @@ ALTER TABLE ONLY public.ticket_yt_channels
     ADD CONSTRAINT ticket_yt_channels_ticket_id_fkey FOREIGN KEY ("ticket_id") REFERENCES public.tickets(id);
 
 ALTER TABLE ONLY public.ticket_yt_channels
-    ADD CONSTRAINT ticket_yt_channels_id_fkey FOREIGN KEY ("yt_channels_id") REFERENCES public.technologies(id);
+    ADD CONSTRAINT ticket_yt_channels_id_fkey FOREIGN KEY ("yt_channels_id") REFERENCES public.yt_channels(id);
 --
 -- public.ticket_resources table
 --
@@ -231,7 +582,7 @@ ALTER TABLE ONLY public.ticket_resources
     ADD CONSTRAINT ticket_resources_ticket_id_fkey FOREIGN KEY ("ticket_id") REFERENCES public.tickets(id);
 
 ALTER TABLE ONLY public.ticket_resources
-    ADD CONSTRAINT ticket_resources_id_fkey FOREIGN KEY ("resources_id") REFERENCES public.technologies(id);
+    ADD CONSTRAINT ticket_resources_id_fkey FOREIGN KEY ("resources_id") REFERENCES public.resources(id);
 --
 -- public.ticket_sources table
 --
@@ -241,7 +592,7 @@ ALTER TABLE ONLY public.ticket_sources
     ADD CONSTRAINT ticket_sources_ticket_id_fkey FOREIGN KEY ("ticket_id") REFERENCES public.tickets(id);
 
 ALTER TABLE ONLY public.ticket_sources
-    ADD CONSTRAINT ticket_sources_sources_id_fkey FOREIGN KEY ("sources_id") REFERENCES public.technologies(id);
+    ADD CONSTRAINT ticket_sources_sources_id_fkey FOREIGN KEY ("sources_id") REFERENCES public.sources(id);
 --
 -- public.ticket_docs table
 --
@@ -251,4 +602,4 @@ ALTER TABLE ONLY public.ticket_docs
     ADD CONSTRAINT ticket_docs_ticket_id_fkey FOREIGN KEY ("ticket_id") REFERENCES public.tickets(id);
 
 ALTER TABLE ONLY public.ticket_docs
-    ADD CONSTRAINT ticket_docs_docs_id_fkey FOREIGN KEY ("docs_id") REFERENCES public.technologies(id);
+    ADD CONSTRAINT ticket_docs_docs_id_fkey FOREIGN KEY ("docs_id") REFERENCES public.docs(id);
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RequestPasswordReset always answers with the same message so it can't be
+// used to find out which emails have an account.
+func (s *ApiServer) RequestPasswordReset(ctx context.Context, req *api.RequestPasswordResetRequest) (*api.RequestPasswordResetResponse, error) {
+	if req.Email == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "email is required")
+	}
+
+	token := genRandomBytesHex(20)
+	var email string
+	err := s.db.conn.QueryRow(ctx, `
+		UPDATE users
+		SET reset_password_token = $2, reset_password_token_expires = now() + $3::interval
+		WHERE email = $1
+		AND deleted_at IS NULL
+		RETURNING email
+	`, req.Email, hashToken(token), s.cfg.resetTTL).Scan(&email)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, status.Errorf(codes.Internal, "failed to request password reset: %v", err)
+	}
+
+	if err == nil {
+		// sending happens in the background so the response time doesn't
+		// tell whether the account exists
+		go func() {
+			if err := s.sendPasswordResetEmail(context.Background(), email, token); err != nil {
+				log.Printf("failed to send password reset email to %s: %v", email, err)
+			}
+		}()
+	}
+
+	return &api.RequestPasswordResetResponse{Message: "if an account exists for this email, a password reset link has been sent to it"}, nil
+}
+
+func (s *ApiServer) ResetPassword(ctx context.Context, req *api.ResetPasswordRequest) (*api.ResetPasswordResponse, error) {
+	if req.Token == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "token is required")
+	}
+	if req.NewPassword == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "new password is required")
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to reset password: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		userID, email       string
+		firstName, lastName sql.NullString
+	)
+	err = tx.QueryRow(ctx, `
+		SELECT id, email, first_name, last_name
+		FROM users
+		WHERE reset_password_token = $1
+		AND reset_password_token_expires > now()
+		AND deleted_at IS NULL
+		FOR UPDATE
+	`, hashToken(req.Token)).Scan(&userID, &email, &firstName, &lastName)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid or expired reset token")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to reset password: %v", err)
+	}
+
+	if err = s.passwordPolicy.check("new_password", req.NewPassword, email, firstName.String, lastName.String); err != nil {
+		return nil, err
+	}
+	passwordHash, err := s.passwords.hash(req.NewPassword)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to reset password: %v", err)
+	}
+
+	// clearing the token makes it single use
+	_, err = tx.Exec(ctx, `
+		UPDATE users
+		SET password = $2, reset_password_token = NULL, reset_password_token_expires = NULL
+		WHERE id = $1
+	`, userID, passwordHash)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to reset password: %v", err)
+	}
+
+	if err = revokeUserSessions(ctx, tx, userID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to reset password: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to reset password: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{actorID: userID, subject: email, action: auditResetPassword, outcome: auditSuccess})
+
+	err = s.mailer.Send(ctx, mail{
+		To:      email,
+		Subject: "Your password was changed",
+		Body:    "The password of your practice tracker account was just reset and all of your sessions were signed out.\n\nIf this wasn't you, please reset your password again right away.\n",
+	})
+	if err != nil {
+		log.Printf("failed to send password changed email to %s: %v", email, err)
+	}
+
+	return &api.ResetPasswordResponse{Message: "password reset, please log in with your new password"}, nil
+}
+
+func (s *ApiServer) sendPasswordResetEmail(ctx context.Context, email, token string) error {
+	sep := "?"
+	if strings.Contains(s.cfg.resetURL, "?") {
+		sep = "&"
+	}
+	link := s.cfg.resetURL + sep + "token=" + url.QueryEscape(token)
+	return s.mailer.Send(ctx, mail{
+		To:      email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Somebody asked to reset the password of your practice tracker account.\n\nOpen the link below to choose a new password:\n\n%s\n\nThe link expires in %s and can only be used once. If you didn't ask for this you can ignore this email.\n",
+			link,
+			s.cfg.resetTTL,
+		),
+	})
+}
@@ -3,12 +3,14 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	api "github.com/HasmikAtom/tracker/v1"
@@ -16,9 +18,9 @@ import (
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/soheilhy/cmux"
-	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -33,10 +35,15 @@ func serveHTTP(l net.Listener, rootMux *http.ServeMux) {
 	}
 }
 
-func serveGRPC(l net.Listener, server *ApiServer, grpcAuthN func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error)) {
-	grpcs := grpc.NewServer(
-		grpc.UnaryInterceptor(grpcAuthN),
-	)
+// serveGRPC serves plain text grpc, or TLS when creds is set.
+func serveGRPC(l net.Listener, server *ApiServer, creds credentials.TransportCredentials, interceptors ...grpc.UnaryServerInterceptor) {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(interceptors...),
+	}
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+	grpcs := grpc.NewServer(opts...)
 	api.RegisterApiServer(grpcs, server)
 	if err := grpcs.Serve(l); err != cmux.ErrListenerClosed {
 		log.Fatalf("Error in GRPC server: %s", err)
@@ -53,13 +60,52 @@ func newDatabase(conn *pgxpool.Pool) *Database {
 	}
 }
 
+// serverConfig holds the settings of the ApiServer that are read from the
+// environment in main.go
+type serverConfig struct {
+	// base url used for the links sent out in emails
+	publicURL      string
+	refreshTTL     time.Duration
+	emailVerifyTTL time.Duration
+	resetTTL       time.Duration
+	// page of the frontend that asks for the new password, the api has
+	// nothing to serve for a link opened in the browser
+	resetURL     string
+	magicLinkTTL time.Duration
+	// first lockout after too many failed logins, it doubles with every
+	// further failure up to maxLockout
+	lockout    time.Duration
+	maxLockout time.Duration
+	// new accounts have to be activated by an admin
+	approvalRequired bool
+	// registrationOpen or registrationInvite
+	registrationMode string
+	// how long deleted accounts can be restored, and how often the purger
+	// looks for accounts past it
+	deletionGrace time.Duration
+	purgeInterval time.Duration
+}
+
 type ApiServer struct {
-	db *Database
+	db     *Database
+	tokens *tokenSigner
+	mailer mailer
+	// encrypts the totp secrets, nil when two-factor authentication is off
+	secrets        *secretBox
+	passwords      *passwordHasher
+	passwordPolicy *passwordPolicy
+	cfg            serverConfig
 }
 
-func newApiServer(db *Database) *ApiServer {
+func newApiServer(db *Database, tokens *tokenSigner, mailer mailer, secrets *secretBox, passwords *passwordHasher, passwordPolicy *passwordPolicy, cfg serverConfig) *ApiServer {
 	return &ApiServer{
 		db,
+		tokens,
+		mailer,
+		secrets,
+		passwords,
+		passwordPolicy,
+		cfg,
 	}
 }
 
@@ -72,12 +118,11 @@ func genRandomBytesHex(amount uint32) string {
 	return hex.EncodeToString(buf)
 }
 
-func hashPassword(password string) string {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), 5)
-	if err != nil {
-		panic(fmt.Errorf("bcrypt.GenerateFromPassword: %v", err))
-	}
-	return string(hash)
+// hashToken is used for tokens that are handed out to clients and only their
+// hash is stored in the database.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 func (s *ApiServer) CreateAccount(ctx context.Context, req *api.CreateAccountRequest) (*api.CreateAccountResponse, error) {
@@ -93,6 +138,17 @@ func (s *ApiServer) CreateAccount(ctx context.Context, req *api.CreateAccountReq
 	if req.LastName == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "lastname is required")
 	}
+	// the other auth methods create their accounts on their first login or
+	// log in to existing ones
+	if req.AuthMethod != "" && req.AuthMethod != authMethodPassword {
+		return nil, status.Errorf(codes.InvalidArgument, "auth method %q can't be used to register", req.AuthMethod)
+	}
+	if err := s.passwordPolicy.check("password", req.Password, req.Email, req.FirstName, req.LastName); err != nil {
+		return nil, err
+	}
+	if req.InviteCode == "" && s.cfg.registrationMode == registrationInvite {
+		return nil, status.Errorf(codes.PermissionDenied, "registration is invite only, an invite code is required")
+	}
 
 	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
@@ -117,62 +173,86 @@ func (s *ApiServer) CreateAccount(ctx context.Context, req *api.CreateAccountReq
 		}
 	}
 
+	// elevated roles are only granted by an admin, directly or with an invite
+	userType := userTypeUser
+	var invite *inviteRecord
+	if req.InviteCode != "" {
+		if invite, err = consumeInvite(ctx, tx, req.InviteCode); err != nil {
+			s.db.recordAudit(ctx, auditEvent{subject: req.Email, action: auditCreateAccount, outcome: auditDenied, detail: "invalid invite code"})
+			return nil, err
+		}
+		if invite.userType.Valid {
+			userType = invite.userType.String
+		}
+	}
+	if req.UserType != "" && req.UserType != userType {
+		return nil, status.Errorf(codes.PermissionDenied, "user type %q can't be used to register", req.UserType)
+	}
+	// an invite is the approval of an admin given ahead
+	approvalRequired := s.cfg.approvalRequired && invite == nil
+
 	emailVerifyToken := genRandomBytesHex(20)
+	passwordHash, err := s.passwords.hash(req.Password)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create account: %v", err)
+	}
 
 	row = tx.QueryRow(ctx, `
-		INSERT INTO users (email, password, first_name, last_name, email_verify_token, user_type, auth_method)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		RETURNING id, email, user_type, activated_at, email_verified, first_name, last_name, auth_method, created_at, deleted_at
-	`,
+		INSERT INTO users (email, password, first_name, last_name, email_verify_token, email_verify_token_expires, user_type, auth_method, activated_at)
+		VALUES ($1, $2, $3, $4, $5, now() + $6::interval, $7, $8, CASE WHEN $9 THEN NULL ELSE now() END)
+		RETURNING `+userColumns,
 		req.Email,
-		hashPassword(req.Password),
+		passwordHash,
 		req.FirstName,
 		req.LastName,
-		emailVerifyToken,
-		req.UserType,
-		req.AuthMethod,
-	)
-	var (
-		user         api.User
-		dbAuthMethod sql.NullString
-		activatedAt  sql.NullTime
-		created      time.Time
-		deleted      sql.NullTime
-	)
-	err = row.Scan(
-		&user.Id,
-		&user.Email,
-		&user.UserType,
-		&activatedAt,
-		&user.EmailVerified,
-		&user.FirstName,
-		&user.LastName,
-		&dbAuthMethod,
-		&created,
-		&deleted,
+		hashToken(emailVerifyToken),
+		s.cfg.emailVerifyTTL,
+		userType,
+		authMethodPassword,
+		approvalRequired,
 	)
+	user, err := scanUser(row)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to create account: %v", err)
 	}
 
-	if dbAuthMethod.Valid {
-		user.AuthMethod = dbAuthMethod.String
-	}
-	if activatedAt.Valid {
-		user.ActivatedAt = timestamppb.New(activatedAt.Time)
-	}
-	if user.CreatedAt = timestamppb.New(created.Truncate(60 * time.Second)); err != nil {
-		return nil, status.Errorf(codes.Internal, "error creating account: %v", err)
+	var detail string
+	if invite != nil {
+		detail = "invite " + invite.id
+		if invite.groupID.Valid {
+			if _, err = tx.Exec(ctx, `
+				INSERT INTO group_users (group_id, user_id, permission)
+				VALUES ($1, $2, $3)
+			`, invite.groupID.String, user.id, groupPermissionMember); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to create account: %v", err)
+			}
+		}
 	}
-	if deleted.Valid {
-		user.DeletedAt = timestamppb.New(deleted.Time.Truncate(60 * time.Second))
+
+	// accounts waiting for approval can't log in yet, so they get no session
+	var tokens *api.SessionTokens
+	message := fmt.Sprintf("Account for the user %s created", user.email)
+	if approvalRequired {
+		message = fmt.Sprintf("Account for the user %s created, you can log in once an admin approved it", user.email)
+	} else {
+		tokens, err = s.newSession(ctx, tx, user.id)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "error creating account: %v", err)
+		}
 	}
 
 	if err = tx.Commit(ctx); err != nil {
 		return nil, status.Errorf(codes.Internal, "error creating account: %v", err)
 	}
+	s.db.recordAudit(ctx, auditEvent{actorID: user.id, subject: user.email, action: auditCreateAccount, outcome: auditSuccess, detail: detail})
+
+	// the account is already created at this point, a failed email can be
+	// sent again with ResendVerification
+	if err = s.sendVerificationEmail(ctx, user.email, emailVerifyToken); err != nil {
+		log.Printf("failed to send verification email to %s: %v", user.email, err)
+	}
 
-	return &api.CreateAccountResponse{User: &user, Message: fmt.Sprintf("Account for the user %s created", user.Email)}, nil
+	return &api.CreateAccountResponse{User: user.toProto(), Message: message, Tokens: tokens}, nil
 }
 
 func (s *ApiServer) Login(ctx context.Context, req *api.LoginRequest) (*api.LoginResponse, error) {
@@ -190,133 +270,269 @@ func (s *ApiServer) Login(ctx context.Context, req *api.LoginRequest) (*api.Logi
 	defer tx.Rollback(ctx)
 
 	row := tx.QueryRow(ctx, `
-		SELECT id, email, password, user_type, activated_at, email_verified, first_name, last_name, auth_method, created_at, deleted_at
+		SELECT `+userColumns+`
 		FROM users
 		WHERE email = $1
 	`, req.Email)
-	var (
-		user         api.User
-		password     string
-		dbAuthMethod sql.NullString
-		activatedAt  sql.NullTime
-		created      time.Time
-		deleted      sql.NullTime
-	)
-	err = row.Scan(
-		&user.Id,
-		&user.Email,
-		&password,
-		&user.UserType,
-		&activatedAt,
-		&user.EmailVerified,
-		&user.FirstName,
-		&user.LastName,
-		&dbAuthMethod,
-		&created,
-		&deleted,
-	)
-	if err != nil {
-		if err != pgx.ErrNoRows {
-			return nil, status.Errorf(codes.InvalidArgument, "user not found")
-		}
-		return nil, status.Errorf(codes.Internal, "failed to login")
+	user, err := scanUser(row)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
 	}
+	found := err == nil
 
-	err = bcrypt.CompareHashAndPassword([]byte(password), []byte(req.Password))
-	if err != nil {
+	var userID string
+	if found {
+		userID = user.id
+	}
+	if err = s.checkLockout(ctx, throttleKeys(ctx, userID)...); err != nil {
+		s.db.recordAudit(ctx, auditEvent{actorID: userID, subject: req.Email, action: auditLogin, outcome: auditDenied, detail: "locked out"})
+		return nil, err
+	}
+
+	var ok, rehash bool
+	if found && user.password.Valid {
+		ok, rehash, err = s.passwords.verify(user.password.String, req.Password)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+	}
+	if !ok {
+		s.db.recordAudit(ctx, auditEvent{actorID: userID, subject: req.Email, action: auditLogin, outcome: auditFailure, detail: "wrong email or password"})
+		if err = s.loginFailed(ctx, userID); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
 		return nil, status.Errorf(codes.NotFound, "email and password don't match")
 	}
 
-	if dbAuthMethod.Valid {
-		user.AuthMethod = dbAuthMethod.String
+	if user.deletedAt.Valid {
+		s.db.recordAudit(ctx, auditEvent{actorID: user.id, subject: user.email, action: auditLogin, outcome: auditDenied, detail: "account deleted"})
+		return nil, errAccountDeleted(user.id, s.purgeAt(user.deletedAt.Time))
 	}
-	if activatedAt.Valid {
-		user.ActivatedAt = timestamppb.New(activatedAt.Time.Truncate(60 * time.Second))
+	if s.cfg.approvalRequired && !user.activatedAt.Valid {
+		s.db.recordAudit(ctx, auditEvent{actorID: user.id, subject: user.email, action: auditLogin, outcome: auditDenied, detail: "waiting for approval"})
+		return nil, errAccountInactive(user.id)
 	}
-	if user.CreatedAt = timestamppb.New(created.Truncate(60 * time.Second)); err != nil {
+
+	// hashes made with an older policy are upgraded while the password is at hand
+	if rehash {
+		hash, err := s.passwords.hash(req.Password)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		if _, err = tx.Exec(ctx, `UPDATE users SET password = $2 WHERE id = $1`, user.id, hash); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+	}
+
+	enabled, err := totpEnabled(ctx, tx, user.id)
+	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
 	}
-	if deleted.Valid {
-		user.DeletedAt = timestamppb.New(deleted.Time.Truncate(60 * time.Second))
+	if enabled {
+		challenge, err := s.newLoginChallenge(user.id)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		// the failed attempts are only forgotten by CompleteLogin
+		if err = tx.Commit(ctx); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		return &api.LoginResponse{Message: "enter the code of your authenticator app to finish logging in", TotpRequired: true, ChallengeToken: challenge}, nil
+	}
+
+	if err = loginSucceeded(ctx, tx, user.id); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+
+	tokens, err := s.newSession(ctx, tx, user.id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
 	}
 
 	if err = tx.Commit(ctx); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
 	}
+	s.db.recordAudit(ctx, auditEvent{actorID: user.id, subject: user.email, action: auditLogin, outcome: auditSuccess, detail: "password"})
 
-	return &api.LoginResponse{User: &user, Message: fmt.Sprintf("user %s successfully logged in", user.Email)}, nil
+	return &api.LoginResponse{User: user.toProto(), Message: fmt.Sprintf("user %s successfully logged in", user.email), Tokens: tokens}, nil
 }
 
 func (s *ApiServer) GetUser(ctx context.Context, req *empty.Empty) (*api.GetUserResponse, error) {
 	userID := ctx.Value(user)
 
-	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	row := s.db.conn.QueryRow(ctx, `
+		SELECT `+userColumns+`
+		FROM users
+		WHERE id = $1
+	`, userID)
+	user, err := scanUser(row)
 	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "user not found")
+		}
 		return nil, status.Errorf(codes.Internal, "failed to retrieve user: %v", err)
 	}
+
+	return &api.GetUserResponse{User: user.toProto(), Message: fmt.Sprintf("user %s retrieved", user.email)}, nil
+}
+
+// updatableUserFields are the paths UpdateUser accepts in its mask.
+// current_password and totp_code are not fields of the user, but the gateway
+// puts them in the masks it infers from the body.
+var updatableUserFields = map[string]bool{
+	"user_type":        true,
+	"password":         true,
+	"first_name":       true,
+	"last_name":        true,
+	"current_password": true,
+	"totp_code":        true,
+}
+
+func (s *ApiServer) UpdateUser(ctx context.Context, req *api.UpdateUserRequest) (*api.UpdateUserResponse, error) {
+	callerID := ctx.Value(user).(string)
+	userID := req.UserId
+	if userID == "" {
+		userID = callerID
+	}
+	body := req.Body
+	if body == nil {
+		body = &api.UpdateUserRequest_UpdateUserResquestBody{}
+	}
+
+	// the paths can be relative to the request or to the body
+	masked := map[string]bool{}
+	for _, path := range req.UpdateMask.GetPaths() {
+		path = strings.TrimPrefix(path, "body.")
+		if !updatableUserFields[path] {
+			return nil, status.Errorf(codes.InvalidArgument, "field %q can't be updated", path)
+		}
+		masked[path] = true
+	}
+	delete(masked, "current_password")
+	delete(masked, "totp_code")
+	if len(masked) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "update mask has no fields to update")
+	}
+
+	role, err := callerRole(ctx, s.db)
+	if err != nil {
+		return nil, err
+	}
+	isAdmin := role >= api.Role_ROLE_ADMIN
+	if userID != callerID && !isAdmin {
+		return nil, status.Errorf(codes.PermissionDenied, "you can only update your own account")
+	}
+	if masked["user_type"] {
+		if !isAdmin {
+			return nil, status.Errorf(codes.PermissionDenied, "only admins can change the user type")
+		}
+		// so the last admin can't demote themselves by accident
+		if userID == callerID {
+			return nil, status.Errorf(codes.PermissionDenied, "you can't change your own user type")
+		}
+		if roleFromUserType(body.UserType) == api.Role_ROLE_UNSPECIFIED {
+			return nil, status.Errorf(codes.InvalidArgument, "user type must be %q or %q", userTypeUser, userTypeAdmin)
+		}
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update user: %v", err)
+	}
 	defer tx.Rollback(ctx)
 
 	row := tx.QueryRow(ctx, `
-		SELECT id, email, user_type, activated_at, email_verified, first_name, last_name, auth_method, created_at, deleted_at
+		SELECT `+userColumns+`
 		FROM users
 		WHERE id = $1
+		AND deleted_at IS NULL
+		FOR UPDATE
 	`, userID)
-	var (
-		user         api.User
-		dbAuthMethod sql.NullString
-		activatedAt  sql.NullTime
-		created      time.Time
-		deleted      sql.NullTime
-	)
-	err = row.Scan(
-		&user.Id,
-		&user.Email,
-		&user.UserType,
-		&activatedAt,
-		&user.EmailVerified,
-		&user.FirstName,
-		&user.LastName,
-		&dbAuthMethod,
-		&created,
-		&deleted,
-	)
+	current, err := scanUser(row)
 	if err != nil {
-		if err != pgx.ErrNoRows {
-			return nil, status.Errorf(codes.InvalidArgument, "user not found")
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to update user: %v", err)
+	}
+	// like with DeleteAccount, one admin can't take over another
+	if userID != callerID && roleFromUserType(current.userType) >= api.Role_ROLE_ADMIN {
+		return nil, status.Errorf(codes.PermissionDenied, "admins can't update other admins")
+	}
+
+	args := []interface{}{userID}
+	var sets, fields []string
+	set := func(field, column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+		fields = append(fields, field)
+	}
+	firstName, lastName := current.firstName.String, current.lastName.String
+	if masked["first_name"] {
+		firstName = body.FirstName
+		set("first_name", "first_name", sql.NullString{String: body.FirstName, Valid: body.FirstName != ""})
+	}
+	if masked["last_name"] {
+		lastName = body.LastName
+		set("last_name", "last_name", sql.NullString{String: body.LastName, Valid: body.LastName != ""})
+	}
+	if masked["user_type"] {
+		set("user_type", "user_type", body.UserType)
+	}
+	if masked["password"] {
+		// somebody holding a stolen session must not be able to take over
+		// the account, the caller confirms with their own credentials, which
+		// an admin resetting the password of somebody else has too
+		caller := current
+		if userID != callerID {
+			row = tx.QueryRow(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, callerID)
+			if caller, err = scanUser(row); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to update user: %v", err)
+			}
 		}
-		return nil, status.Errorf(codes.Internal, "failed to retrieve user")
+		if err = s.reauthenticate(ctx, tx, caller, body.CurrentPassword, body.TotpCode); err != nil {
+			s.db.recordAudit(ctx, auditEvent{subject: userID, action: auditUpdateAccount, outcome: auditDenied, detail: "re-authentication failed"})
+			return nil, err
+		}
+		if err = s.passwordPolicy.check("body.password", body.Password, current.email, firstName, lastName); err != nil {
+			return nil, err
+		}
+		hash, err := s.passwords.hash(body.Password)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to update user: %v", err)
+		}
+		set("password", "password", hash)
 	}
 
-	if dbAuthMethod.Valid {
-		user.AuthMethod = dbAuthMethod.String
-	}
-	if activatedAt.Valid {
-		user.ActivatedAt = timestamppb.New(activatedAt.Time.Truncate(60 * time.Second))
-	}
-	if user.CreatedAt = timestamppb.New(created.Truncate(60 * time.Second)); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to retrieve user: %v", err)
+	row = tx.QueryRow(ctx, `
+		UPDATE users
+		SET `+strings.Join(sets, ", ")+`
+		WHERE id = $1
+		RETURNING `+userColumns,
+		args...,
+	)
+	updated, err := scanUser(row)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update user: %v", err)
 	}
-	if deleted.Valid {
-		user.DeletedAt = timestamppb.New(deleted.Time.Truncate(60 * time.Second))
+
+	// a new password signs out everywhere else
+	if masked["password"] {
+		currentSession := ""
+		if userID == callerID {
+			currentSession, _ = ctx.Value(session).(string)
+		}
+		if _, err = revokeOtherSessions(ctx, tx, userID, currentSession); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to update user: %v", err)
+		}
 	}
 
 	if err = tx.Commit(ctx); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to retrieve user: %v", err)
+		return nil, status.Errorf(codes.Internal, "failed to update user: %v", err)
 	}
+	s.db.recordAudit(ctx, auditEvent{subject: userID, action: auditUpdateAccount, outcome: auditSuccess, detail: strings.Join(fields, ",")})
 
-	return &api.GetUserResponse{User: &user, Message: fmt.Sprintf("user %s retrieved", user.Email)}, nil
-}
-
-func (s *ApiServer) UpdateUser(ctx context.Context, req *api.UpdateUserRequest) (*api.UpdateUserResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "not implemented")
-}
-
-func (s *ApiServer) DeleteAccount(ctx context.Context, req *api.DeleteAccountRequest) (*api.DeleteAccountResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "not implemented")
-}
-
-func (s *ApiServer) CreateTicket(ctx context.Context, req *api.CreateTicketRequest) (*api.CreateTicketResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "not implemented")
+	return &api.UpdateUserResponse{User: updated.toProto(), Message: fmt.Sprintf("user %s updated", updated.email)}, nil
 }
 
 func (s *ApiServer) ListTickets(ctx context.Context, req *emptypb.Empty) (*api.ListTicketsResponse, error) {
@@ -327,18 +543,6 @@ func (s *ApiServer) FilterTickets(ctx context.Context, req *api.FilterTicketsReq
 	return nil, status.Errorf(codes.Unimplemented, "not implemented")
 }
 
-func (s *ApiServer) GetTicket(ctx context.Context, req *api.GetTicketRequest) (*api.GetTicketResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "not implemented")
-}
-
-func (s *ApiServer) UpdateTicket(ctx context.Context, req *api.UpdateTicketRequest) (*api.UpdateTicketResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "not implemented")
-}
-
-func (s *ApiServer) DeleteTicket(ctx context.Context, req *api.DeleteTicketRequest) (*api.DeleteTicketResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "not implemented")
-}
-
 func (s *ApiServer) CreateGroup(ctx context.Context, req *api.CreateGroupRequest) (*api.CreateGroupResponse, error) {
 	userID := ctx.Value(user)
 	if req.Name == "" {
@@ -390,7 +594,7 @@ func (s *ApiServer) CreateGroup(ctx context.Context, req *api.CreateGroupRequest
 	row = tx.QueryRow(ctx, `
 		INSERT INTO group_users (group_id, user_id, permission)
 		VALUES ($1, $2, $3)
-	`, group.Id, group.UserId, "admin")
+	`, group.Id, group.UserId, groupPermissionAdmin)
 
 	err = row.Scan()
 	if err != pgx.ErrNoRows {
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// sessions are seen again at most once a minute so the authentication of busy
+// clients doesn't write on every request
+const sessionSeenInterval = time.Minute
+
+// newSession starts a new session for the user and returns the first pair of
+// tokens for it. The session id doubles as the refresh token family and is
+// carried inside the access tokens.
+func (s *ApiServer) newSession(ctx context.Context, tx pgx.Tx, userID string) (*api.SessionTokens, error) {
+	var sessionID string
+	err := tx.QueryRow(ctx, `
+		INSERT INTO sessions (user_id, user_agent, ip)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, userID, userAgent(ctx), clientIP(ctx)).Scan(&sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return s.issueSessionTokens(ctx, tx, userID, sessionID)
+}
+
+func (s *ApiServer) issueSessionTokens(ctx context.Context, tx pgx.Tx, userID, familyID string) (*api.SessionTokens, error) {
+	refreshToken := genRandomBytesHex(32)
+
+	var refreshExpires time.Time
+	err := tx.QueryRow(ctx, `
+		INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, now() + $4::interval)
+		RETURNING expires_at
+	`, userID, familyID, hashToken(refreshToken), s.cfg.refreshTTL).Scan(&refreshExpires)
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, accessExpires, err := s.tokens.issue(userID, familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.SessionTokens{
+		AccessToken:           accessToken,
+		AccessTokenExpiresAt:  timestamppb.New(accessExpires),
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: timestamppb.New(refreshExpires),
+	}, nil
+}
+
+func (s *ApiServer) RefreshSession(ctx context.Context, req *api.RefreshSessionRequest) (*api.RefreshSessionResponse, error) {
+	if req.RefreshToken == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "refresh token is required")
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to refresh session: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	row := tx.QueryRow(ctx, `
+		SELECT id, user_id, family_id, expires_at < now(), rotated_at, revoked_at
+		FROM refresh_tokens
+		WHERE token_hash = $1
+		FOR UPDATE
+	`, hashToken(req.RefreshToken))
+	var (
+		id       string
+		userID   string
+		familyID string
+		expired  bool
+		rotated  sql.NullTime
+		revoked  sql.NullTime
+	)
+	err = row.Scan(&id, &userID, &familyID, &expired, &rotated, &revoked)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.Unauthenticated, "invalid refresh token")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to refresh session: %v", err)
+	}
+
+	if revoked.Valid {
+		return nil, status.Errorf(codes.Unauthenticated, "session revoked, please log in again")
+	}
+	if rotated.Valid {
+		// The token was already exchanged once, so either the client or an
+		// attacker holds a stolen copy. Revoke the whole session.
+		if err = revokeSession(ctx, tx, familyID); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to refresh session: %v", err)
+		}
+		if err = tx.Commit(ctx); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to refresh session: %v", err)
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "refresh token reuse detected, please log in again")
+	}
+	if expired {
+		return nil, status.Errorf(codes.Unauthenticated, "session expired, please log in again")
+	}
+
+	if _, err = tx.Exec(ctx, `
+		UPDATE refresh_tokens
+		SET rotated_at = now()
+		WHERE id = $1
+	`, id); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to refresh session: %v", err)
+	}
+
+	tokens, err := s.issueSessionTokens(ctx, tx, userID, familyID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to refresh session: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to refresh session: %v", err)
+	}
+
+	return &api.RefreshSessionResponse{Tokens: tokens, Message: "session refreshed"}, nil
+}
+
+func (s *ApiServer) Logout(ctx context.Context, req *api.LogoutRequest) (*api.LogoutResponse, error) {
+	if req.RefreshToken == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "refresh token is required")
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to log out: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var familyID string
+	err = tx.QueryRow(ctx, `
+		SELECT family_id
+		FROM refresh_tokens
+		WHERE token_hash = $1
+	`, hashToken(req.RefreshToken)).Scan(&familyID)
+	if err != nil {
+		// an unknown token has nothing left to log out of
+		if err == pgx.ErrNoRows {
+			return &api.LogoutResponse{Message: "logged out"}, nil
+		}
+		return nil, status.Errorf(codes.Internal, "failed to log out: %v", err)
+	}
+
+	if err = revokeSession(ctx, tx, familyID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to log out: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to log out: %v", err)
+	}
+
+	return &api.LogoutResponse{Message: "logged out"}, nil
+}
+
+// revokeSession ends the session, its refresh tokens can't be used anymore
+// and its access tokens are refused by the authenticator.
+func revokeSession(ctx context.Context, tx pgx.Tx, sessionID string) error {
+	if _, err := tx.Exec(ctx, `
+		UPDATE sessions
+		SET revoked_at = now()
+		WHERE id = $1
+		AND revoked_at IS NULL
+	`, sessionID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, `
+		UPDATE refresh_tokens
+		SET revoked_at = now()
+		WHERE family_id = $1
+		AND revoked_at IS NULL
+	`, sessionID)
+	return err
+}
+
+// revokeUserSessions revokes every session of the user.
+func revokeUserSessions(ctx context.Context, tx pgx.Tx, userID string) error {
+	if _, err := tx.Exec(ctx, `
+		UPDATE sessions
+		SET revoked_at = now()
+		WHERE user_id = $1
+		AND revoked_at IS NULL
+	`, userID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, `
+		UPDATE refresh_tokens
+		SET revoked_at = now()
+		WHERE user_id = $1
+		AND revoked_at IS NULL
+	`, userID)
+	return err
+}
+
+// revokeOtherSessions revokes every session of the user but current, and
+// returns how many there were.
+func revokeOtherSessions(ctx context.Context, tx pgx.Tx, userID, current string) (int, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT id
+		FROM sessions
+		WHERE user_id = $1
+		AND id <> $2
+		AND revoked_at IS NULL
+	`, userID, current)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if err = revokeSession(ctx, tx, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+// checkSession refuses access tokens of revoked sessions, and keeps track of
+// when and from where the session was last used.
+func (a *authenticator) checkSession(ctx context.Context, sessionID string) error {
+	var revoked, stale bool
+	err := a.db.conn.QueryRow(ctx, `
+		SELECT revoked_at IS NOT NULL, last_seen_at < now() - $2::interval
+		FROM sessions
+		WHERE id = $1
+	`, sessionID, sessionSeenInterval).Scan(&revoked, &stale)
+	if err != nil && err != pgx.ErrNoRows {
+		return status.Errorf(codes.Internal, "failed to authenticate: %v", err)
+	}
+	if err == pgx.ErrNoRows || revoked {
+		return status.Errorf(codes.Unauthenticated, "session revoked, please log in again")
+	}
+
+	if stale {
+		if _, err = a.db.conn.Exec(ctx, `
+			UPDATE sessions
+			SET last_seen_at = now(), ip = COALESCE(NULLIF($2, ''), ip)
+			WHERE id = $1
+		`, sessionID, clientIP(ctx)); err != nil {
+			return status.Errorf(codes.Internal, "failed to authenticate: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *ApiServer) ListSessions(ctx context.Context, req *empty.Empty) (*api.ListSessionsResponse, error) {
+	userID := ctx.Value(user)
+	current, _ := ctx.Value(session).(string)
+
+	// a session is over once it is revoked or its refresh token expired
+	rows, err := s.db.conn.Query(ctx, `
+		SELECT id, user_agent, ip, created_at, last_seen_at
+		FROM sessions
+		WHERE user_id = $1
+		AND revoked_at IS NULL
+		AND EXISTS (
+			SELECT 1
+			FROM refresh_tokens
+			WHERE family_id = sessions.id
+			AND rotated_at IS NULL
+			AND revoked_at IS NULL
+			AND expires_at > now()
+		)
+		ORDER BY last_seen_at DESC
+	`, userID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list sessions: %v", err)
+	}
+	defer rows.Close()
+
+	sessions := []*api.Session{}
+	for rows.Next() {
+		var (
+			sess              api.Session
+			created, lastSeen time.Time
+		)
+		if err = rows.Scan(&sess.Id, &sess.UserAgent, &sess.Ip, &created, &lastSeen); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to list sessions: %v", err)
+		}
+		sess.CreatedAt = timestamppb.New(created)
+		sess.LastSeenAt = timestamppb.New(lastSeen)
+		sess.Current = sess.Id == current
+		sessions = append(sessions, &sess)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list sessions: %v", err)
+	}
+
+	return &api.ListSessionsResponse{Sessions: sessions, Message: fmt.Sprintf("%d active sessions", len(sessions))}, nil
+}
+
+func (s *ApiServer) RevokeSession(ctx context.Context, req *api.RevokeSessionRequest) (*api.RevokeSessionResponse, error) {
+	userID := ctx.Value(user)
+	if req.SessionId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "session id is required")
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revoke session: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// sessions of other users are reported as missing
+	var exists bool
+	err = tx.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM sessions WHERE id = $1 AND user_id = $2)
+	`, req.SessionId, userID).Scan(&exists)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revoke session: %v", err)
+	}
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "session not found")
+	}
+
+	if err = revokeSession(ctx, tx, req.SessionId); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revoke session: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revoke session: %v", err)
+	}
+
+	return &api.RevokeSessionResponse{Message: fmt.Sprintf("session %s revoked", req.SessionId)}, nil
+}
+
+func (s *ApiServer) RevokeAllOtherSessions(ctx context.Context, req *empty.Empty) (*api.RevokeAllOtherSessionsResponse, error) {
+	userID := ctx.Value(user).(string)
+	current, _ := ctx.Value(session).(string)
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revoke sessions: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	revoked, err := revokeOtherSessions(ctx, tx, userID, current)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revoke sessions: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revoke sessions: %v", err)
+	}
+
+	return &api.RevokeAllOtherSessionsResponse{Message: fmt.Sprintf("%d other sessions revoked", revoked)}, nil
+}
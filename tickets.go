@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ticketTaxonomy is a catalog of names, like the languages, and the link
+// table that attaches them to tickets. The catalog table is also the name of
+// the ticket field in update masks.
+type ticketTaxonomy struct {
+	link, idColumn, table, nameColumn string
+	field                             func(*api.Ticket) *[]string
+}
+
+var ticketTaxonomies = []ticketTaxonomy{
+	{"ticket_lang", "lang_id", "languages", "lang_name", func(t *api.Ticket) *[]string { return &t.Languages }},
+	{"ticket_tech", "tech_id", "technologies", "tech_name", func(t *api.Ticket) *[]string { return &t.Technologies }},
+	{"ticket_yt_channels", "yt_channels_id", "yt_channels", "ytch_name", func(t *api.Ticket) *[]string { return &t.YtChannels }},
+	{"ticket_resources", "resources_id", "resources", "rscs_name", func(t *api.Ticket) *[]string { return &t.Resources }},
+	{"ticket_sources", "sources_id", "sources", "src_name", func(t *api.Ticket) *[]string { return &t.Sources }},
+	{"ticket_docs", "docs_id", "docs", "docs_name", func(t *api.Ticket) *[]string { return &t.Docs }},
+}
+
+// ticketSelect reads a ticket with the names of all its taxonomies in one
+// query, each taxonomy is an array subquery ordered like it was linked.
+var ticketSelect = func() string {
+	columns := []string{
+		"tickets.id",
+		"tickets.user_id",
+		"COALESCE(tickets.topic, '')",
+		"COALESCE(tickets.repo, '')",
+		"COALESCE(tickets.status_info, '')",
+		"COALESCE(tickets.summary, '')",
+		"tickets.created_at",
+		"tickets.deleted_at",
+	}
+	for _, tax := range ticketTaxonomies {
+		columns = append(columns, fmt.Sprintf(`ARRAY(
+			SELECT COALESCE(names.%[4]s, '')
+			FROM %[1]s link
+			JOIN %[3]s names ON names.id = link.%[2]s
+			WHERE link.ticket_id = tickets.id
+			AND link.deleted_at IS NULL
+			ORDER BY link.created_at
+		)`, tax.link, tax.idColumn, tax.table, tax.nameColumn))
+	}
+	return "SELECT " + strings.Join(columns, ", ") + " FROM tickets"
+}()
+
+func scanTicket(row pgx.Row) (*api.Ticket, error) {
+	var (
+		t       api.Ticket
+		created time.Time
+		deleted sql.NullTime
+	)
+	dest := []interface{}{&t.Id, &t.UserId, &t.Topic, &t.Repo, &t.StatusInfo, &t.Summary, &created, &deleted}
+	for _, tax := range ticketTaxonomies {
+		dest = append(dest, tax.field(&t))
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	t.CreatedAt = timestamppb.New(created.Truncate(60 * time.Second))
+	if deleted.Valid {
+		t.DeletedAt = timestamppb.New(deleted.Time.Truncate(60 * time.Second))
+	}
+	return &t, nil
+}
+
+// The permissions of group_users that let members change the tickets shared
+// to the group, the others can only read them.
+const (
+	groupPermissionAdmin = "admin"
+	groupPermissionWrite = "write"
+)
+
+// ticketReadAccess and ticketWriteAccess limit a query on tickets to the ones
+// the user in $2 owns or can read, or change, through a group the ticket is
+// shared to.
+var (
+	ticketReadAccess  = ticketAccess("")
+	ticketWriteAccess = ticketAccess(fmt.Sprintf(
+		"AND group_users.permission IN ('%s', '%s')",
+		groupPermissionAdmin,
+		groupPermissionWrite,
+	))
+)
+
+func ticketAccess(permission string) string {
+	return `
+	AND (
+		tickets.user_id = $2
+		OR EXISTS (
+			SELECT 1
+			FROM group_tickets
+			JOIN group_users ON group_users.group_id = group_tickets.group_id
+			JOIN groups ON groups.id = group_tickets.group_id
+			WHERE group_tickets.ticket_id = tickets.id
+			AND group_tickets.deleted_at IS NULL
+			AND group_users.user_id = $2
+			AND group_users.deleted_at IS NULL
+			AND groups.deleted_at IS NULL
+			` + permission + `
+		)
+	)`
+}
+
+// errTicketNotWritable tells apart the tickets the user can read but not
+// change from the ones they can't see at all.
+func (s *ApiServer) errTicketNotWritable(ctx context.Context, ticketID, userID string) error {
+	var readable bool
+	err := s.db.conn.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1
+			FROM tickets
+			WHERE tickets.id = $1
+			AND tickets.deleted_at IS NULL
+	`+ticketReadAccess+`
+		)
+	`, ticketID, userID).Scan(&readable)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to check ticket access: %v", err)
+	}
+	if readable {
+		return status.Errorf(codes.PermissionDenied, "you can only read this ticket")
+	}
+	return status.Errorf(codes.NotFound, "ticket not found")
+}
+
+// cleanTaxonomyNames trims the names and drops the ones repeated in another
+// case, the catalogs don't tell them apart.
+func cleanTaxonomyNames(table string, names []string) ([]string, error) {
+	seen := map[string]bool{}
+	var cleaned []string
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "%s can't contain empty names", table)
+		}
+		if key := strings.ToLower(name); !seen[key] {
+			seen[key] = true
+			cleaned = append(cleaned, name)
+		}
+	}
+	return cleaned, nil
+}
+
+// upsertTaxonomy returns the id of the name in the catalog, adding it when
+// it is new. The name keeps the case it was first added with.
+func upsertTaxonomy(ctx context.Context, tx pgx.Tx, tax ticketTaxonomy, name string) (string, error) {
+	// the no-op update makes the existing row come back from RETURNING
+	var id string
+	err := tx.QueryRow(ctx, fmt.Sprintf(`
+		INSERT INTO %[1]s (%[2]s)
+		VALUES ($1)
+		ON CONFLICT (lower(%[2]s)) DO UPDATE SET %[2]s = %[1]s.%[2]s
+		RETURNING id
+	`, tax.table, tax.nameColumn), name).Scan(&id)
+	return id, err
+}
+
+// syncTicketTaxonomy makes names the linked names of the taxonomy. Links that
+// are kept stay untouched, the removed ones are soft deleted.
+func syncTicketTaxonomy(ctx context.Context, tx pgx.Tx, ticketID string, tax ticketTaxonomy, names []string) error {
+	cleaned, err := cleanTaxonomyNames(tax.table, names)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(ctx, fmt.Sprintf(`
+		SELECT %s
+		FROM %s
+		WHERE ticket_id = $1
+		AND deleted_at IS NULL
+	`, tax.idColumn, tax.link), ticketID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to save %s: %v", tax.table, err)
+	}
+	linked := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return status.Errorf(codes.Internal, "failed to save %s: %v", tax.table, err)
+		}
+		linked[id] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return status.Errorf(codes.Internal, "failed to save %s: %v", tax.table, err)
+	}
+
+	for _, name := range cleaned {
+		id, err := upsertTaxonomy(ctx, tx, tax, name)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to save %s: %v", tax.table, err)
+		}
+		if linked[id] {
+			delete(linked, id)
+			continue
+		}
+		if _, err = tx.Exec(ctx, fmt.Sprintf(`
+			INSERT INTO %s (ticket_id, %s)
+			VALUES ($1, $2)
+		`, tax.link, tax.idColumn), ticketID, id); err != nil {
+			return status.Errorf(codes.Internal, "failed to save %s: %v", tax.table, err)
+		}
+	}
+
+	// what is left in linked was not asked for anymore
+	for id := range linked {
+		if _, err = tx.Exec(ctx, fmt.Sprintf(`
+			UPDATE %s
+			SET deleted_at = now()
+			WHERE ticket_id = $1
+			AND %s = $2
+			AND deleted_at IS NULL
+		`, tax.link, tax.idColumn), ticketID, id); err != nil {
+			return status.Errorf(codes.Internal, "failed to save %s: %v", tax.table, err)
+		}
+	}
+	return nil
+}
+
+func (s *ApiServer) CreateTicket(ctx context.Context, req *api.CreateTicketRequest) (*api.CreateTicketResponse, error) {
+	// tickets always belong to the caller
+	userID := ctx.Value(user).(string)
+	if req.UserId != "" && req.UserId != userID {
+		return nil, status.Errorf(codes.PermissionDenied, "tickets can only be created for yourself")
+	}
+	if strings.TrimSpace(req.Topic) == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "topic is required")
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create ticket: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var ticketID string
+	err = tx.QueryRow(ctx, `
+		INSERT INTO tickets (user_id, topic, repo, status_info, summary)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`,
+		userID,
+		strings.TrimSpace(req.Topic),
+		req.Repo,
+		req.StatusInfo,
+		req.Summary,
+	).Scan(&ticketID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create ticket: %v", err)
+	}
+
+	requested := api.Ticket{
+		Languages:    req.Languages,
+		Technologies: req.Technologies,
+		YtChannels:   req.YtChannels,
+		Resources:    req.Resources,
+		Sources:      req.Sources,
+		Docs:         req.Docs,
+	}
+	for _, tax := range ticketTaxonomies {
+		if err = syncTicketTaxonomy(ctx, tx, ticketID, tax, *tax.field(&requested)); err != nil {
+			return nil, err
+		}
+	}
+
+	ticket, err := scanTicket(tx.QueryRow(ctx, ticketSelect+` WHERE tickets.id = $1`, ticketID))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create ticket: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create ticket: %v", err)
+	}
+	return &api.CreateTicketResponse{Ticket: ticket, Message: fmt.Sprintf("ticket %s created", ticket.Topic)}, nil
+}
+
+func (s *ApiServer) GetTicket(ctx context.Context, req *api.GetTicketRequest) (*api.GetTicketResponse, error) {
+	userID := ctx.Value(user).(string)
+	if req.TicketId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "ticket id is required")
+	}
+
+	ticket, err := scanTicket(s.db.conn.QueryRow(ctx, ticketSelect+`
+		WHERE tickets.id = $1
+		AND tickets.deleted_at IS NULL
+	`+ticketReadAccess, req.TicketId, userID))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "ticket not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to retrieve ticket: %v", err)
+	}
+
+	return &api.GetTicketResponse{Ticket: ticket, Message: fmt.Sprintf("ticket %s retrieved", ticket.Topic)}, nil
+}
+
+func (s *ApiServer) UpdateTicket(ctx context.Context, req *api.UpdateTicketRequest) (*api.UpdateTicketResponse, error) {
+	userID := ctx.Value(user).(string)
+	if req.TicketId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "ticket id is required")
+	}
+	body := req.Body
+	if body == nil {
+		body = &api.UpdateTicketRequest_UpdateTicketRequestBody{}
+	}
+	requested := api.Ticket{
+		Topic:        strings.TrimSpace(body.Topic),
+		Repo:         body.Repo,
+		StatusInfo:   body.StatusInfo,
+		Summary:      body.Summary,
+		Languages:    body.Languages,
+		Technologies: body.Technologies,
+		YtChannels:   body.YtChannels,
+		Resources:    body.Resources,
+		Sources:      body.Sources,
+		Docs:         body.Docs,
+	}
+	columns := map[string]string{
+		"topic":       requested.Topic,
+		"repo":        requested.Repo,
+		"status_info": requested.StatusInfo,
+		"summary":     requested.Summary,
+	}
+	taxonomies := map[string]ticketTaxonomy{}
+	for _, tax := range ticketTaxonomies {
+		taxonomies[tax.table] = tax
+	}
+
+	// the paths can be relative to the request or to the body
+	masked := map[string]bool{}
+	for _, path := range req.UpdateMask.GetPaths() {
+		path = strings.TrimPrefix(path, "body.")
+		if path == "user_id" {
+			return nil, status.Errorf(codes.InvalidArgument, "the owner of a ticket can't be changed")
+		}
+		if _, ok := columns[path]; !ok {
+			if _, ok = taxonomies[path]; !ok {
+				return nil, status.Errorf(codes.InvalidArgument, "field %q can't be updated", path)
+			}
+		}
+		masked[path] = true
+	}
+	if len(masked) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "update mask has no fields to update")
+	}
+	if masked["topic"] && requested.Topic == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "topic can't be empty")
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update ticket: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var ticketID string
+	err = tx.QueryRow(ctx, `
+		SELECT tickets.id
+		FROM tickets
+		WHERE tickets.id = $1
+		AND tickets.deleted_at IS NULL
+	`+ticketWriteAccess+`
+		FOR UPDATE OF tickets
+	`, req.TicketId, userID).Scan(&ticketID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, s.errTicketNotWritable(ctx, req.TicketId, userID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to update ticket: %v", err)
+	}
+
+	args := []interface{}{ticketID}
+	var sets []string
+	for _, column := range []string{"topic", "repo", "status_info", "summary"} {
+		if masked[column] {
+			args = append(args, columns[column])
+			sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+		}
+	}
+	if len(sets) > 0 {
+		if _, err = tx.Exec(ctx, `
+			UPDATE tickets
+			SET `+strings.Join(sets, ", ")+`
+			WHERE id = $1
+		`, args...); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to update ticket: %v", err)
+		}
+	}
+	for _, tax := range ticketTaxonomies {
+		if !masked[tax.table] {
+			continue
+		}
+		if err = syncTicketTaxonomy(ctx, tx, ticketID, tax, *tax.field(&requested)); err != nil {
+			return nil, err
+		}
+	}
+
+	ticket, err := scanTicket(tx.QueryRow(ctx, ticketSelect+` WHERE tickets.id = $1`, ticketID))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update ticket: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update ticket: %v", err)
+	}
+	return &api.UpdateTicketResponse{Ticket: ticket, Message: fmt.Sprintf("ticket %s updated", ticket.Topic)}, nil
+}
+
+// DeleteTicket soft deletes the ticket for the owner and the members that can
+// change it through a group. Only the owner can delete it permanently, deleted
+// tickets included.
+func (s *ApiServer) DeleteTicket(ctx context.Context, req *api.DeleteTicketRequest) (*api.DeleteTicketResponse, error) {
+	userID := ctx.Value(user).(string)
+	if req.TicketId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "ticket id is required")
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete ticket: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var ownerID, topic string
+	err = tx.QueryRow(ctx, `
+		SELECT tickets.user_id, COALESCE(tickets.topic, '')
+		FROM tickets
+		WHERE tickets.id = $1
+		AND ($3 OR tickets.deleted_at IS NULL)
+	`+ticketWriteAccess+`
+		FOR UPDATE OF tickets
+	`, req.TicketId, userID, req.Perm).Scan(&ownerID, &topic)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, s.errTicketNotWritable(ctx, req.TicketId, userID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to delete ticket: %v", err)
+	}
+
+	message := fmt.Sprintf("ticket %s deleted", topic)
+	if req.Perm {
+		if ownerID != userID {
+			return nil, status.Errorf(codes.PermissionDenied, "only the owner can delete a ticket permanently")
+		}
+		var stmts []string
+		for _, tax := range ticketTaxonomies {
+			stmts = append(stmts, fmt.Sprintf(`DELETE FROM %s WHERE ticket_id = $1`, tax.link))
+		}
+		stmts = append(stmts,
+			`DELETE FROM group_tickets WHERE ticket_id = $1`,
+			`DELETE FROM tickets WHERE id = $1`,
+		)
+		for _, stmt := range stmts {
+			if _, err = tx.Exec(ctx, stmt, req.TicketId); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to delete ticket: %v", err)
+			}
+		}
+		message = fmt.Sprintf("ticket %s permanently deleted", topic)
+	} else {
+		if _, err = tx.Exec(ctx, `
+			UPDATE tickets
+			SET deleted_at = now()
+			WHERE id = $1
+		`, req.TicketId); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete ticket: %v", err)
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete ticket: %v", err)
+	}
+	return &api.DeleteTicketResponse{Message: message}, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	errMissingToken = errors.New("missing session token")
+	errInvalidToken = errors.New("invalid session token")
+	errExpiredToken = errors.New("session token expired")
+)
+
+// Every sealed value carries its type so that one kind of token can't be
+// passed off as another.
+const (
+	tokenTypeAccess    = "access"
+	tokenTypeOIDCState = "oidc_state"
+	tokenTypeChallenge = "login_challenge"
+)
+
+// sessionClaims is the payload carried inside a signed session token.
+type sessionClaims struct {
+	Type      string `json:"typ"`
+	Subject   string `json:"sub"`
+	SessionID string `json:"sid"`
+	// the admin acting as the subject, the session is the admin's
+	Impersonator string `json:"imp,omitempty"`
+	IssuedAt     int64  `json:"iat"`
+	ExpiresAt    int64  `json:"exp"`
+}
+
+// tokenSigner issues and verifies HMAC-SHA256 signed session tokens.
+// A token has the form base64url(claims) + "." + base64url(signature).
+type tokenSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+func newTokenSigner(key []byte, ttl time.Duration) *tokenSigner {
+	return &tokenSigner{
+		key,
+		ttl,
+	}
+}
+
+func (t *tokenSigner) issue(userID, sessionID string) (string, time.Time, error) {
+	return t.impersonate(userID, sessionID, "")
+}
+
+// impersonate issues an access token that acts as the user on behalf of the
+// impersonator, sessionID is the session of the impersonator.
+func (t *tokenSigner) impersonate(userID, sessionID, impersonator string) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(t.ttl)
+	token, err := t.seal(sessionClaims{
+		Type:         tokenTypeAccess,
+		Subject:      userID,
+		SessionID:    sessionID,
+		Impersonator: impersonator,
+		IssuedAt:     now.Unix(),
+		ExpiresAt:    expires.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expires, nil
+}
+
+func (t *tokenSigner) verify(token string) (*sessionClaims, error) {
+	if token == "" {
+		return nil, errMissingToken
+	}
+	var claims sessionClaims
+	if err := t.unseal(token, &claims); err != nil {
+		return nil, err
+	}
+	if claims.Type != tokenTypeAccess || claims.Subject == "" {
+		return nil, errInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errExpiredToken
+	}
+	return &claims, nil
+}
+
+// seal signs any json encodable value. Besides the session tokens it is used
+// for short lived values that are handed to clients and have to come back
+// unchanged, like the oidc state cookie.
+func (t *tokenSigner) seal(v interface{}) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(t.sign(encoded)), nil
+}
+
+// unseal checks the signature of a sealed value and decodes it into v.
+func (t *tokenSigner) unseal(token string, v interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return errInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errInvalidToken
+	}
+	if !hmac.Equal(sig, t.sign(parts[0])) {
+		return errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errInvalidToken
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+func (t *tokenSigner) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenSignerVerify(t *testing.T) {
+	signer := newTokenSigner([]byte("test key"), time.Hour)
+	valid, _, err := signer.issue("user-1", "session-1")
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	expired, _, err := newTokenSigner([]byte("test key"), -time.Minute).issue("user-1", "session-1")
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	otherKey, _, err := newTokenSigner([]byte("other key"), time.Hour).issue("user-1", "session-1")
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	challenge, err := signer.seal(sessionClaims{
+		Type:      tokenTypeChallenge,
+		Subject:   "user-1",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	noSubject, err := signer.seal(sessionClaims{
+		Type:      tokenTypeAccess,
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", valid, nil},
+		{"empty", "", errMissingToken},
+		{"expired", expired, errExpiredToken},
+		{"signed with another key", otherKey, errInvalidToken},
+		{"another token type", challenge, errInvalidToken},
+		{"no subject", noSubject, errInvalidToken},
+		{"no signature", parts[0], errInvalidToken},
+		{"tampered payload", parts[0] + "x." + parts[1], errInvalidToken},
+		{"tampered signature", parts[0] + "." + parts[1][:len(parts[1])-2] + "AA", errInvalidToken},
+		{"signature not base64", parts[0] + ".!!", errInvalidToken},
+		{"too many parts", valid + ".x", errInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := signer.verify(tt.token)
+			if err != tt.err {
+				t.Fatalf("verify() error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if claims.Subject != "user-1" || claims.SessionID != "session-1" {
+				t.Errorf("verify() = %+v, want subject user-1 and session session-1", claims)
+			}
+		})
+	}
+}
+
+func TestTokenSignerSealRoundTrip(t *testing.T) {
+	signer := newTokenSigner([]byte("test key"), time.Hour)
+	type state struct {
+		Nonce    string `json:"nonce"`
+		Redirect string `json:"redirect"`
+	}
+	tests := []struct {
+		name string
+		in   state
+	}{
+		{"empty", state{}},
+		{"values", state{Nonce: "abc", Redirect: "/tickets"}},
+		{"separator in value", state{Nonce: "a.b.c", Redirect: "https://example.com/?a=b&c=d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := signer.seal(tt.in)
+			if err != nil {
+				t.Fatalf("seal: %v", err)
+			}
+			var out state
+			if err = signer.unseal(sealed, &out); err != nil {
+				t.Fatalf("unseal: %v", err)
+			}
+			if out != tt.in {
+				t.Errorf("unseal() = %+v, want %+v", out, tt.in)
+			}
+		})
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	totpIssuer        = "Practice Tracker"
+	totpPeriod        = 30
+	totpDigits        = 6
+	recoveryCodeCount = 10
+	challengeTTL      = 5 * time.Minute
+)
+
+// secretBox encrypts secrets that have to be stored in a way they can be read
+// back, like the totp secrets. It uses AES-GCM with a random nonce that is
+// stored in front of the ciphertext.
+type secretBox struct {
+	aead cipher.AEAD
+}
+
+func newSecretBox(key []byte) (*secretBox, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &secretBox{aead}, nil
+}
+
+func (b *secretBox) seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return b.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (b *secretBox) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < b.aead.NonceSize() {
+		return nil, errors.New("sealed secret too short")
+	}
+	nonce, ciphertext := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+	return b.aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// totpCode computes the RFC 6238 code for the given time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verifyTOTP checks the code against the current time step and one step on
+// either side for clock drift. Steps up to lastStep were already used and are
+// rejected so a code can't be replayed.
+func verifyTOTP(secret []byte, code string, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	current := time.Now().Unix() / totpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// normalizeRecoveryCode accepts recovery codes with or without the dash and
+// in any case.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
+
+// loginChallenge is handed out by Login instead of the session when the user
+// still has to pass the second factor.
+type loginChallenge struct {
+	Type      string `json:"typ"`
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func (s *ApiServer) newLoginChallenge(userID string) (string, error) {
+	return s.tokens.seal(loginChallenge{
+		Type:      tokenTypeChallenge,
+		Subject:   userID,
+		ExpiresAt: time.Now().Add(challengeTTL).Unix(),
+	})
+}
+
+// totpEnabled reports whether the user has to pass the second factor to log in.
+func totpEnabled(ctx context.Context, tx pgx.Tx, userID string) (bool, error) {
+	var enabled bool
+	err := tx.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL)
+	`, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// checkTOTP verifies a code of the user's authenticator app, and marks its
+// time step as used.
+func (s *ApiServer) checkTOTP(ctx context.Context, tx pgx.Tx, userID, code string, enabled bool) (bool, error) {
+	var (
+		sealed   []byte
+		lastStep int64
+	)
+	err := tx.QueryRow(ctx, `
+		SELECT secret, last_used_step
+		FROM user_totp
+		WHERE user_id = $1
+		AND (enabled_at IS NOT NULL) = $2
+		FOR UPDATE
+	`, userID, enabled).Scan(&sealed, &lastStep)
+	if err != nil {
+		return false, err
+	}
+	secret, err := s.secrets.open(sealed)
+	if err != nil {
+		return false, err
+	}
+	step, ok := verifyTOTP(secret, code, lastStep)
+	if !ok {
+		return false, nil
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE user_totp
+		SET last_used_step = $2
+		WHERE user_id = $1
+	`, userID, step)
+	return err == nil, err
+}
+
+func (s *ApiServer) CompleteLogin(ctx context.Context, req *api.CompleteLoginRequest) (*api.LoginResponse, error) {
+	if req.ChallengeToken == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "challenge token is required")
+	}
+	if req.Code == "" && req.RecoveryCode == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "code or recovery code is required")
+	}
+	if s.secrets == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "two-factor authentication is not enabled on this server")
+	}
+
+	var challenge loginChallenge
+	if err := s.tokens.unseal(req.ChallengeToken, &challenge); err != nil || challenge.Type != tokenTypeChallenge {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid challenge token")
+	}
+	if time.Now().Unix() >= challenge.ExpiresAt {
+		return nil, status.Errorf(codes.Unauthenticated, "login expired, please log in again")
+	}
+
+	// the codes are short, so guessing them counts towards the lockout too
+	if err := s.checkLockout(ctx, throttleKeys(ctx, challenge.Subject)...); err != nil {
+		s.db.recordAudit(ctx, auditEvent{actorID: challenge.Subject, action: auditLogin, outcome: auditDenied, detail: "locked out"})
+		return nil, err
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var ok bool
+	method := "totp"
+	if req.Code != "" {
+		ok, err = s.checkTOTP(ctx, tx, challenge.Subject, req.Code, true)
+		if err != nil && err != pgx.ErrNoRows {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+	} else {
+		method = "recovery code"
+		tag, err := tx.Exec(ctx, `
+			UPDATE totp_recovery_codes
+			SET used_at = now()
+			WHERE user_id = $1
+			AND code_hash = $2
+			AND used_at IS NULL
+		`, challenge.Subject, hashToken(normalizeRecoveryCode(req.RecoveryCode)))
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		ok = tag.RowsAffected() == 1
+	}
+	if !ok {
+		s.db.recordAudit(ctx, auditEvent{actorID: challenge.Subject, action: auditLogin, outcome: auditFailure, detail: "wrong " + method})
+		if err = s.loginFailed(ctx, challenge.Subject); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "invalid code")
+	}
+	if err = loginSucceeded(ctx, tx, challenge.Subject); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+
+	row := tx.QueryRow(ctx, `
+		SELECT `+userColumns+`
+		FROM users
+		WHERE id = $1
+		AND deleted_at IS NULL
+	`, challenge.Subject)
+	user, err := scanUser(row)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.Unauthenticated, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+	if s.cfg.approvalRequired && !user.activatedAt.Valid {
+		return nil, errAccountInactive(user.id)
+	}
+
+	tokens, err := s.newSession(ctx, tx, user.id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to login: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{actorID: user.id, subject: user.email, action: auditLogin, outcome: auditSuccess, detail: method})
+
+	return &api.LoginResponse{User: user.toProto(), Message: fmt.Sprintf("user %s successfully logged in", user.email), Tokens: tokens}, nil
+}
+
+func (s *ApiServer) EnrollTotp(ctx context.Context, req *empty.Empty) (*api.EnrollTotpResponse, error) {
+	userID := ctx.Value(user)
+	if s.secrets == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "two-factor authentication is not enabled on this server")
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to enroll totp: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var email string
+	if err = tx.QueryRow(ctx, `SELECT email FROM users WHERE id = $1`, userID).Scan(&email); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to enroll totp: %v", err)
+	}
+
+	secret := make([]byte, 20)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to enroll totp: %v", err)
+	}
+	sealed, err := s.secrets.seal(secret)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to enroll totp: %v", err)
+	}
+
+	// enrolling again before confirming replaces the pending secret
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO user_totp (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, last_used_step = 0, created_at = now()
+		WHERE user_totp.enabled_at IS NULL
+	`, userID, sealed)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to enroll totp: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "two-factor authentication is already enabled")
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to enroll totp: %v", err)
+	}
+
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + totpIssuer + ":" + email,
+		RawQuery: url.Values{
+			"secret":    {encoded},
+			"issuer":    {totpIssuer},
+			"algorithm": {"SHA1"},
+			"digits":    {fmt.Sprint(totpDigits)},
+			"period":    {fmt.Sprint(totpPeriod)},
+		}.Encode(),
+	}
+
+	return &api.EnrollTotpResponse{Secret: encoded, OtpauthUri: uri.String(), Message: "scan the code with your authenticator app and confirm it with ConfirmTotp"}, nil
+}
+
+func (s *ApiServer) ConfirmTotp(ctx context.Context, req *api.ConfirmTotpRequest) (*api.ConfirmTotpResponse, error) {
+	userID := ctx.Value(user).(string)
+	if req.Code == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "code is required")
+	}
+	if s.secrets == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "two-factor authentication is not enabled on this server")
+	}
+
+	// a stolen session shouldn't be enough to guess the code, so misses
+	// count towards the lockout like in CompleteLogin
+	if err := s.checkLockout(ctx, throttleKeys(ctx, userID)...); err != nil {
+		s.db.recordAudit(ctx, auditEvent{action: auditEnableTotp, outcome: auditDenied, detail: "locked out"})
+		return nil, err
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to confirm totp: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	ok, err := s.checkTOTP(ctx, tx, userID, req.Code, false)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.FailedPrecondition, "no pending totp enrollment, call EnrollTotp first")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to confirm totp: %v", err)
+	}
+	if !ok {
+		s.db.recordAudit(ctx, auditEvent{action: auditEnableTotp, outcome: auditFailure, detail: "wrong totp"})
+		if err = s.loginFailed(ctx, userID); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to confirm totp: %v", err)
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "invalid code")
+	}
+
+	if _, err = tx.Exec(ctx, `UPDATE user_totp SET enabled_at = now() WHERE user_id = $1`, userID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to confirm totp: %v", err)
+	}
+	if _, err = tx.Exec(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to confirm totp: %v", err)
+	}
+
+	recoveryCodes := make([]string, recoveryCodeCount)
+	for i := range recoveryCodes {
+		code := genRandomBytesHex(5)
+		recoveryCodes[i] = code[:5] + "-" + code[5:]
+		if _, err = tx.Exec(ctx, `
+			INSERT INTO totp_recovery_codes (user_id, code_hash)
+			VALUES ($1, $2)
+		`, userID, hashToken(code)); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to confirm totp: %v", err)
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to confirm totp: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{action: auditEnableTotp, outcome: auditSuccess})
+
+	return &api.ConfirmTotpResponse{RecoveryCodes: recoveryCodes, Message: "two-factor authentication enabled, keep the recovery codes somewhere safe"}, nil
+}
+
+func (s *ApiServer) DisableTotp(ctx context.Context, req *api.DisableTotpRequest) (*api.DisableTotpResponse, error) {
+	userID := ctx.Value(user).(string)
+	if req.Code == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "code is required")
+	}
+	if s.secrets == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "two-factor authentication is not enabled on this server")
+	}
+
+	// misses count towards the lockout, see ConfirmTotp
+	if err := s.checkLockout(ctx, throttleKeys(ctx, userID)...); err != nil {
+		s.db.recordAudit(ctx, auditEvent{action: auditDisableTotp, outcome: auditDenied, detail: "locked out"})
+		return nil, err
+	}
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to disable totp: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	ok, err := s.checkTOTP(ctx, tx, userID, req.Code, true)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.FailedPrecondition, "two-factor authentication is not enabled")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to disable totp: %v", err)
+	}
+	if !ok {
+		s.db.recordAudit(ctx, auditEvent{action: auditDisableTotp, outcome: auditFailure, detail: "wrong totp"})
+		if err = s.loginFailed(ctx, userID); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to disable totp: %v", err)
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "invalid code")
+	}
+
+	if _, err = tx.Exec(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to disable totp: %v", err)
+	}
+	if _, err = tx.Exec(ctx, `DELETE FROM user_totp WHERE user_id = $1`, userID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to disable totp: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to disable totp: %v", err)
+	}
+	s.db.recordAudit(ctx, auditEvent{action: auditDisableTotp, outcome: auditSuccess})
+
+	return &api.DisableTotpResponse{Message: "two-factor authentication disabled"}, nil
+}
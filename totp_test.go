@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// the SHA1 test vectors of RFC 6238 appendix B, cut to six digits
+func TestTotpCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(secret, tt.unix/totpPeriod); got != tt.code {
+			t.Errorf("totpCode(%d) = %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	current := time.Now().Unix() / totpPeriod
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		step     int64
+		ok       bool
+	}{
+		{"current step", totpCode(secret, current), 0, current, true},
+		{"previous step", totpCode(secret, current-1), 0, current - 1, true},
+		{"surrounding spaces", " " + totpCode(secret, current) + " ", 0, current, true},
+		{"too old", totpCode(secret, current-3), 0, 0, false},
+		{"already used", totpCode(secret, current), current + 1, 0, false},
+		{"empty", "", 0, 0, false},
+		{"wrong length", totpCode(secret, current)[:5], 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := verifyTOTP(secret, tt.code, tt.lastStep)
+			if ok != tt.ok {
+				t.Fatalf("verifyTOTP() ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && step != tt.step {
+				t.Errorf("verifyTOTP() step = %d, want %d", step, tt.step)
+			}
+		})
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"abcde-12345", "abcde12345"},
+		{"ABCDE-12345", "abcde12345"},
+		{" abcde12345 ", "abcde12345"},
+	}
+	for _, tt := range tests {
+		if got := normalizeRecoveryCode(tt.in); got != tt.want {
+			t.Errorf("normalizeRecoveryCode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// userRecord is the full row of the users table. It holds the password hash
+// and the secret tokens, so it must never be returned to clients directly,
+// use toProto to get the public view of the user.
+type userRecord struct {
+	id                        string
+	email                     string
+	password                  sql.NullString
+	userType                  string
+	activatedAt               sql.NullTime
+	emailVerified             bool
+	firstName                 sql.NullString
+	lastName                  sql.NullString
+	authMethod                sql.NullString
+	resetPasswordToken        sql.NullString
+	emailVerifyToken          sql.NullString
+	resetPasswordTokenExpires sql.NullTime
+	createdAt                 time.Time
+	deletedAt                 sql.NullTime
+}
+
+// userColumns are the users columns in the order scanUser expects them.
+const userColumns = `id, email, password, user_type, activated_at, email_verified, first_name, last_name, auth_method,
+	reset_password_token, email_verify_token, reset_password_token_expires, created_at, deleted_at`
+
+func scanUser(row pgx.Row) (*userRecord, error) {
+	var u userRecord
+	err := row.Scan(
+		&u.id,
+		&u.email,
+		&u.password,
+		&u.userType,
+		&u.activatedAt,
+		&u.emailVerified,
+		&u.firstName,
+		&u.lastName,
+		&u.authMethod,
+		&u.resetPasswordToken,
+		&u.emailVerifyToken,
+		&u.resetPasswordTokenExpires,
+		&u.createdAt,
+		&u.deletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// toProto returns the public view of the user, leaving out every secret field.
+func (u *userRecord) toProto() *api.User {
+	user := &api.User{
+		Id:            u.id,
+		Email:         u.email,
+		UserType:      u.userType,
+		EmailVerified: u.emailVerified,
+		FirstName:     u.firstName.String,
+		LastName:      u.lastName.String,
+		AuthMethod:    u.authMethod.String,
+		CreatedAt:     timestamppb.New(u.createdAt.Truncate(60 * time.Second)),
+	}
+	if u.activatedAt.Valid {
+		user.ActivatedAt = timestamppb.New(u.activatedAt.Time.Truncate(60 * time.Second))
+	}
+	if u.deletedAt.Valid {
+		user.DeletedAt = timestamppb.New(u.deletedAt.Time.Truncate(60 * time.Second))
+	}
+	return user
+}
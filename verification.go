@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	api "github.com/HasmikAtom/tracker/v1"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *ApiServer) sendVerificationEmail(ctx context.Context, email, token string) error {
+	link := s.cfg.publicURL + "/v1/verify-email?token=" + url.QueryEscape(token)
+	return s.mailer.Send(ctx, mail{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf(
+			"Welcome to the practice tracker!\n\nPlease confirm your email address by opening the link below:\n\n%s\n\nThe link expires in %s.\n",
+			link,
+			s.cfg.emailVerifyTTL,
+		),
+	})
+}
+
+func (s *ApiServer) VerifyEmail(ctx context.Context, req *api.VerifyEmailRequest) (*api.VerifyEmailResponse, error) {
+	if req.Token == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "token is required")
+	}
+
+	var email string
+	err := s.db.conn.QueryRow(ctx, `
+		UPDATE users
+		SET email_verified = true, email_verify_token = NULL, email_verify_token_expires = NULL
+		WHERE email_verify_token = $1
+		AND email_verify_token_expires > now()
+		AND deleted_at IS NULL
+		RETURNING email
+	`, hashToken(req.Token)).Scan(&email)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid or expired verification token")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to verify email: %v", err)
+	}
+
+	return &api.VerifyEmailResponse{Message: fmt.Sprintf("email %s verified", email)}, nil
+}
+
+func (s *ApiServer) ResendVerification(ctx context.Context, req *empty.Empty) (*api.ResendVerificationResponse, error) {
+	userID := ctx.Value(user)
+
+	tx, err := s.db.conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to resend verification: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		email    string
+		verified bool
+	)
+	err = tx.QueryRow(ctx, `
+		SELECT email, email_verified
+		FROM users
+		WHERE id = $1
+		FOR UPDATE
+	`, userID).Scan(&email, &verified)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to resend verification: %v", err)
+	}
+	if verified {
+		return nil, status.Errorf(codes.FailedPrecondition, "email %s is already verified", email)
+	}
+
+	// a new token replaces the old one, so only the latest email works
+	token := genRandomBytesHex(20)
+	_, err = tx.Exec(ctx, `
+		UPDATE users
+		SET email_verify_token = $2, email_verify_token_expires = now() + $3::interval
+		WHERE id = $1
+	`, userID, hashToken(token), s.cfg.emailVerifyTTL)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to resend verification: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to resend verification: %v", err)
+	}
+
+	if err = s.sendVerificationEmail(ctx, email, token); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to send verification email: %v", err)
+	}
+
+	return &api.ResendVerificationResponse{Message: fmt.Sprintf("verification email sent to %s", email)}, nil
+}